@@ -0,0 +1,372 @@
+package creeperkeeper
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalArchive is a copy of archive.vine.co on the local filesystem, laid out
+// like the original: posts/<id>.json, profiles/<id>.json, and video files at
+// the same paths they have in the posts' video URLs.
+type LocalArchive struct {
+	Root   string
+	tmpDir string
+}
+
+// OpenArchive opens a local archive directory or a tarball (optionally
+// gzipped) of one. Tarballs are extracted to a temporary directory that's
+// removed by Close.
+func OpenArchive(name string) (*LocalArchive, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	a := &LocalArchive{}
+	dir := name
+	if !info.IsDir() {
+		a.tmpDir, err = ioutil.TempDir("", "crkr_archive")
+		if err != nil {
+			return nil, err
+		}
+		err = extractTarball(a.tmpDir, name)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("extract %s: %s", name, err)
+		}
+		dir = a.tmpDir
+	}
+	a.Root, err = findArchiveRoot(dir)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Close removes any temporary files created by OpenArchive.
+func (a *LocalArchive) Close() error {
+	if a.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(a.tmpDir)
+}
+
+// Vine reads the metadata for a single post.
+func (a *LocalArchive) Vine(id string) (Vine, error) {
+	var jv jsonVine
+	err := decodeFile(filepath.Join(a.Root, "posts", id+".json"), &jv)
+	if err != nil {
+		return Vine{}, err
+	}
+	return jv.vine(id)
+}
+
+// UserVines reads the metadata for all of a user's posts.
+func (a *LocalArchive) UserVines(userID string) ([]Vine, error) {
+	var ju jsonUser
+	err := decodeFile(filepath.Join(a.Root, "profiles", userID+".json"), &ju)
+	if err != nil {
+		return nil, err
+	}
+	return a.vines(ju.Posts)
+}
+
+// AllVines reads the metadata for every post in the archive.
+func (a *LocalArchive) AllVines() ([]Vine, error) {
+	files, err := filepath.Glob(filepath.Join(a.Root, "posts", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(files))
+	for i, f := range files {
+		ids[i] = strings.TrimSuffix(filepath.Base(f), ".json")
+	}
+	return a.vines(ids)
+}
+
+func (a *LocalArchive) vines(ids []string) ([]Vine, error) {
+	nerr := 0
+	var vines []Vine
+	for _, id := range ids {
+		vine, err := a.Vine(id)
+		if err != nil {
+			nerr++
+			log.Printf("read post %s: %s", id, err)
+			continue
+		}
+		vines = append(vines, vine)
+	}
+	if nerr > 0 {
+		return vines, fmt.Errorf("read post metadata: %d/%d failed", nerr, len(ids))
+	}
+	return vines, nil
+}
+
+// VideoFile returns the path of the archive's copy of a vine's video, if it
+// has one. The path from the video URL is tried first, followed by
+// videos/<name> and <name>, where name is the last element of the URL path,
+// and finally videos/<UUID>.mp4.
+func (a *LocalArchive) VideoFile(v Vine) (string, bool) {
+	var candidates []string
+	if u, err := url.Parse(v.URL); err == nil && u.Path != "" {
+		p := path.Clean("/" + u.Path)
+		candidates = append(candidates,
+			filepath.FromSlash(p[1:]),
+			filepath.Join("videos", path.Base(p)),
+			path.Base(p))
+	}
+	candidates = append(candidates, filepath.Join("videos", v.UUID+".mp4"))
+	for _, c := range candidates {
+		name := filepath.Join(a.Root, c)
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// ImportVideos copies vines' videos out of the archive, named like
+// DownloadVines names them, and returns a copy of vines updated with the
+// videos' sizes and checksums, so the vines' metadata should be written
+// afterward. Videos that aren't in the archive are downloaded if download is
+// true. If probe is true videos are also checked with ffprobe, and ones that
+// fail are removed. Videos are imported Jobs.Download at a time, and
+// importing stops when ctx is done.
+func (a *LocalArchive) ImportVideos(ctx context.Context, vines []Vine, download, probe bool) ([]Vine, error) {
+	updated := make([]Vine, len(vines))
+	copy(updated, vines)
+	// Jobs are pointers into updated so the workers can update them.
+	// Repeated vines are only imported once, so two workers don't write the
+	// same .part file.
+	jobs, copyDupes := dedupeJobs(updated)
+	var imports, missingJobs []*Vine
+	var missing []Vine
+	for _, v := range jobs {
+		if _, ok := a.VideoFile(*v); !ok && download {
+			missing = append(missing, *v)
+			missingJobs = append(missingJobs, v)
+		} else {
+			imports = append(imports, v)
+		}
+	}
+
+	f := func(ctx context.Context, vine *Vine) (struct{}, error) {
+		src, ok := a.VideoFile(*vine)
+		if !ok {
+			err := fmt.Errorf("video not in archive")
+			log.Printf("import %s: %s", vine.UUID, err)
+			return struct{}{}, err
+		}
+		err := importFile(vine.VideoFilename(), src)
+		if err != nil {
+			log.Printf("import %s: %s", vine.UUID, err)
+			return struct{}{}, err
+		} else if Verbose {
+			log.Printf("imported %q", vine.Title)
+		}
+		err = recordChecksum(ctx, vine, probe)
+		if err != nil {
+			if probe && ctx.Err() == nil {
+				os.Remove(vine.VideoFilename())
+			}
+			log.Printf("verify %.20q: %s", vine.Title, err)
+		}
+		return struct{}{}, err
+	}
+	pool := poolOptions{
+		atOnce:  Jobs.Download,
+		stage:   "import",
+		jobName: func(i int) string { return imports[i].UUID },
+	}
+	results := parallel(ctx, imports, pool, f)
+	nerr := 0
+	if be, ok := batchError(ctx, "", results).(*BatchError); ok {
+		nerr += len(be.Errs)
+	}
+
+	if len(missing) > 0 {
+		opts := DownloadOptions{Force: true, Probe: probe}
+		if err := DownloadVinesContext(ctx, missing, opts); err != nil {
+			log.Printf("download videos missing from archive: %s", err)
+			if be, ok := err.(*BatchError); ok {
+				nerr += len(be.Errs)
+			} else {
+				nerr += len(missing)
+			}
+		}
+		for i, v := range missing {
+			*missingJobs[i] = v
+		}
+	}
+	copyDupes()
+	if ctx.Err() != nil {
+		return updated, fmt.Errorf("%d/%d failed: %s", nerr, len(vines), ctx.Err())
+	}
+	if nerr > 0 {
+		return updated, fmt.Errorf("%d/%d failed", nerr, len(vines))
+	}
+	return updated, nil
+}
+
+// importFile copies src to dst. The copy is made in dst+".part" and only
+// renamed to dst once it's complete and synced to disk, so a failed or
+// interrupted copy never leaves a truncated video that looks imported.
+func importFile(dst, src string) (err error) {
+	err = mkdirFor(dst)
+	if err != nil {
+		return err
+	}
+	part := dst + partExt
+	defer func() {
+		if err != nil {
+			os.Remove(part)
+		}
+	}()
+	partFile, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	srcFile, err := os.Open(src)
+	if err != nil {
+		partFile.Close()
+		return err
+	}
+	defer srcFile.Close()
+	_, err = io.Copy(partFile, srcFile)
+	if err == nil {
+		err = partFile.Sync()
+	}
+	if cerr := partFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(part, dst)
+}
+
+// findArchiveRoot returns dir if it contains a posts or profiles directory,
+// or else its only subdirectory that does. Mirrors are often wrapped in a
+// directory named for the host.
+func findArchiveRoot(dir string) (string, error) {
+	if isArchiveRoot(dir) {
+		return dir, nil
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var roots []string
+	for _, info := range infos {
+		sub := filepath.Join(dir, info.Name())
+		if info.IsDir() && isArchiveRoot(sub) {
+			roots = append(roots, sub)
+		}
+	}
+	if len(roots) != 1 {
+		return "", fmt.Errorf("%s: no posts or profiles directory", dir)
+	}
+	return roots[0], nil
+}
+
+func isArchiveRoot(dir string) bool {
+	for _, sub := range []string{"posts", "profiles"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// extractTarball extracts the regular files and directories in a tar file,
+// which may be gzipped, into dir.
+func extractTarball(dir, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel := path.Clean("/" + hdr.Name)[1:]
+		if rel == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(rel))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = writeTarFile(target, tr)
+		default:
+			// Links and devices aren't part of an archive mirror.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeTarFile(name string, r io.Reader) (err error) {
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// decodeFile unmarshals a JSON file.
+func decodeFile(name string, v interface{}) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%s: unrecognized json: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package creeperkeeper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache, if not nil, stores API responses so they don't need to be fetched
+// again. Videos aren't cached.
+var Cache *HTTPCache
+
+// HTTPCache is a persistent cache of HTTP response bodies, keyed by URL.
+// Cached responses are revalidated with conditional requests using their ETag
+// or Last-Modified headers.
+type HTTPCache struct {
+	Dir string
+}
+
+type cacheEntry struct {
+	URL          string
+	ETag         string
+	LastModified string
+	Fetched      time.Time
+	Body         []byte
+}
+
+const cacheExt = ".cache"
+
+// NewHTTPCache returns a cache that stores entries in dir, creating it if
+// necessary.
+func NewHTTPCache(dir string) (*HTTPCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPCache{Dir: dir}, nil
+}
+
+// DefaultCacheDir returns the directory used for the cache if none is given.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "crkr"), nil
+}
+
+// fetch GETs url and returns the response body, using a cached copy if the
+// server says it's still valid. A nil cache fetches url normally.
+func (c *HTTPCache) fetch(ctx context.Context, url string) ([]byte, error) {
+	var entry *cacheEntry
+	header := http.Header{}
+	if c != nil {
+		entry = c.load(url)
+		if entry != nil {
+			if entry.ETag != "" {
+				header.Set("If-None-Match", entry.ETag)
+			}
+			if entry.LastModified != "" {
+				header.Set("If-Modified-Since", entry.LastModified)
+			}
+		}
+	}
+
+	resp, err := httpGet(ctx, url, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		if Verbose {
+			log.Printf("cache hit: %s", url)
+		}
+		// Refresh the modification time so the entry survives pruning.
+		now := time.Now()
+		os.Chtimes(c.filename(url), now, now)
+		return entry.Body, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError{resp.StatusCode, string(body)}
+	}
+	if c != nil {
+		err := c.store(&cacheEntry{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Fetched:      time.Now(),
+			Body:         body,
+		})
+		if err != nil {
+			log.Printf("cache %s: %s", url, err)
+		}
+	}
+	return body, nil
+}
+
+func (c *HTTPCache) filename(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+cacheExt)
+}
+
+// load returns the cache entry for url, or nil if there isn't a usable one.
+func (c *HTTPCache) load(url string) *cacheEntry {
+	b, err := ioutil.ReadFile(c.filename(url))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	err = json.Unmarshal(b, &entry)
+	if err != nil || entry.URL != url {
+		return nil
+	}
+	return &entry
+}
+
+// store writes a cache entry atomically, so concurrent fetches and
+// interruptions can't leave a partial entry.
+func (c *HTTPCache) store(entry *cacheEntry) error {
+	if entry.ETag == "" && entry.LastModified == "" {
+		// Without validators the entry could never be used.
+		return nil
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.Dir, "tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.filename(entry.URL))
+}
+
+// Prune removes entries that haven't been fetched or revalidated within
+// maxAge, along with any leftover temporary files. If maxAge is zero all
+// entries are removed.
+func (c *HTTPCache) Prune(maxAge time.Duration) (removed int, err error) {
+	infos, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return 0, err
+	}
+	nerr := 0
+	for _, info := range infos {
+		name := info.Name()
+		isEntry := strings.HasSuffix(name, cacheExt)
+		isTemp := strings.HasPrefix(name, "tmp")
+		if !isEntry && !isTemp {
+			continue
+		}
+		if isEntry && maxAge > 0 && time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		err := os.Remove(filepath.Join(c.Dir, name))
+		if err != nil {
+			nerr++
+			log.Printf("prune cache: %s", err)
+			continue
+		}
+		removed++
+	}
+	if nerr > 0 {
+		return removed, fmt.Errorf("prune cache: %d files couldn't be removed", nerr)
+	}
+	return removed, nil
+}
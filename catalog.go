@@ -0,0 +1,253 @@
+package creeperkeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CatalogVersion is the version of the catalog file format.
+const CatalogVersion = 1
+
+// A Catalog is an index of every vine that's been downloaded or imported, so
+// they can be found and made into playlists without reading each metadata
+// file. It's kept in a single JSON file, which get, sync, and import-archive
+// add vines to and hardsub records rendered subtitles in.
+type Catalog struct {
+	Version int
+	// Entries are sorted by Video.
+	Entries []CatalogEntry
+}
+
+// A CatalogEntry is a vine's metadata along with where its files are.
+type CatalogEntry struct {
+	Vine
+	// Video and Metadata are absolute paths.
+	Video    string
+	Metadata string
+	// Subtitles and Subtitled are the vine's subtitles and its video with
+	// the subtitles rendered onto it, if they've been made.
+	Subtitles string `json:",omitempty"`
+	Subtitled string `json:",omitempty"`
+	// Added is when the vine was first added to the catalog, and Updated
+	// when its entry last changed.
+	Added   time.Time
+	Updated time.Time
+}
+
+// DefaultCatalogFile returns the catalog used if none is given.
+func DefaultCatalogFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "crkr", "catalog.json"), nil
+}
+
+// ReadCatalog reads a catalog file. If it doesn't exist an empty catalog is
+// returned.
+func ReadCatalog(name string) (*Catalog, error) {
+	c := &Catalog{Version: CatalogVersion}
+	err := decodeFile(name, c)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Version != CatalogVersion {
+		return nil, fmt.Errorf("%s: unsupported catalog version %d", name, c.Version)
+	}
+	for i := range c.Entries {
+		e := &c.Entries[i]
+		// The vine's files are wherever it was written.
+		e.Vine.base = strings.TrimSuffix(e.Metadata, ".json")
+	}
+	return c, nil
+}
+
+// Write saves the catalog, replacing the file atomically.
+func (c *Catalog) Write(name string) error {
+	c.Version = CatalogVersion
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp_catalog")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// UpdateCatalog reads the catalog file name, calls f with it, and writes it
+// back if f succeeds. The file isn't locked, so if two processes update it at
+// once one of their changes is lost.
+func UpdateCatalog(name string, f func(c *Catalog) error) error {
+	c, err := ReadCatalog(name)
+	if err != nil {
+		return err
+	}
+	err = f(c)
+	if err != nil {
+		return err
+	}
+	return c.Write(name)
+}
+
+// Add adds vines to the catalog, or updates their entries if their videos
+// are already in it. Vines' files are found as for VideoFilename, so it
+// should be called after their metadata is written.
+func (c *Catalog) Add(vines []Vine) error {
+	now := time.Now().UTC()
+	for _, v := range vines {
+		video, err := filepath.Abs(v.VideoFilename())
+		if err != nil {
+			return err
+		}
+		meta, err := filepath.Abs(v.MetadataFilename())
+		if err != nil {
+			return err
+		}
+		v.base = strings.TrimSuffix(meta, ".json")
+		i, ok := c.find(video)
+		if !ok {
+			c.Entries = append(c.Entries, CatalogEntry{})
+			copy(c.Entries[i+1:], c.Entries[i:])
+			c.Entries[i] = CatalogEntry{Video: video, Added: now}
+		}
+		e := &c.Entries[i]
+		e.Vine = v
+		e.Metadata = meta
+		e.Updated = now
+		e.checkFiles()
+	}
+	return nil
+}
+
+// Refresh updates the subtitle state of the entries for the given video
+// files, eg after rendering subtitles for them. Videos that aren't in the
+// catalog are ignored.
+func (c *Catalog) Refresh(videos []string) error {
+	now := time.Now().UTC()
+	for _, video := range videos {
+		video, err := filepath.Abs(video)
+		if err != nil {
+			return err
+		}
+		i, ok := c.find(video)
+		if !ok {
+			continue
+		}
+		e := &c.Entries[i]
+		subs, subbed := e.Subtitles, e.Subtitled
+		e.checkFiles()
+		if e.Subtitles != subs || e.Subtitled != subbed {
+			e.Updated = now
+		}
+	}
+	return nil
+}
+
+// find returns the index of the entry for video, or where it would be
+// inserted.
+func (c *Catalog) find(video string) (int, bool) {
+	i := sort.Search(len(c.Entries), func(i int) bool {
+		return c.Entries[i].Video >= video
+	})
+	return i, i < len(c.Entries) && c.Entries[i].Video == video
+}
+
+// checkFiles records which of the vine's derived files exist.
+func (e *CatalogEntry) checkFiles() {
+	e.Subtitles, e.Subtitled = "", ""
+	if srt := e.Vine.SubtitlesFilename(); FileExists(srt) {
+		e.Subtitles = srt
+	}
+	if subbed := SubtitledVideoFilename(e.Video); FileExists(subbed) {
+		e.Subtitled = subbed
+	}
+}
+
+// A CatalogQuery selects and orders catalog entries.
+type CatalogQuery struct {
+	Filter
+	// Subtitled, if true, only selects vines whose subtitles have been
+	// rendered.
+	Subtitled bool
+	// Sort is the name of the field to sort by, one of SortFields. A leading
+	// "-" sorts in descending order. Entries are in catalog order if it's
+	// empty.
+	Sort string
+	// Offset and Limit are applied after sorting, as for LimitVines.
+	Offset, Limit int
+}
+
+// SortFields are the fields catalog entries can be sorted by.
+var SortFields = []string{"created", "title", "uploader", "loops", "likes", "reposts", "comments", "added"}
+
+var catalogLess = map[string]func(a, b *CatalogEntry) bool{
+	"created":  func(a, b *CatalogEntry) bool { return a.Created.Before(b.Created) },
+	"title":    func(a, b *CatalogEntry) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) },
+	"uploader": func(a, b *CatalogEntry) bool { return strings.ToLower(a.Uploader) < strings.ToLower(b.Uploader) },
+	"loops":    func(a, b *CatalogEntry) bool { return a.Loops < b.Loops },
+	"likes":    func(a, b *CatalogEntry) bool { return a.Likes < b.Likes },
+	"reposts":  func(a, b *CatalogEntry) bool { return a.Reposts < b.Reposts },
+	"comments": func(a, b *CatalogEntry) bool { return a.Comments < b.Comments },
+	"added":    func(a, b *CatalogEntry) bool { return a.Added.Before(b.Added) },
+}
+
+// Query returns the entries selected by q, in its order.
+func (c *Catalog) Query(q CatalogQuery) ([]CatalogEntry, error) {
+	field := strings.ToLower(strings.TrimPrefix(q.Sort, "-"))
+	less, ok := catalogLess[field]
+	if q.Sort != "" && !ok {
+		return nil, fmt.Errorf("can't sort by %q, want one of %s", q.Sort, strings.Join(SortFields, ", "))
+	}
+	entries := []CatalogEntry{}
+	for _, e := range c.Entries {
+		if !q.Keep(e.Vine) || (q.Subtitled && e.Subtitled == "") {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if less != nil {
+		desc := strings.HasPrefix(q.Sort, "-")
+		sort.SliceStable(entries, func(i, j int) bool {
+			if desc {
+				return less(&entries[j], &entries[i])
+			}
+			return less(&entries[i], &entries[j])
+		})
+	}
+	return limitSlice(entries, q.Offset, q.Limit), nil
+}
+
+// CatalogVines returns the entries' vines, which keep track of where their
+// files are, eg for writing a playlist.
+func CatalogVines(entries []CatalogEntry) []Vine {
+	vines := make([]Vine, len(entries))
+	for i, e := range entries {
+		vines[i] = e.Vine
+	}
+	return vines
+}
@@ -0,0 +1,141 @@
+package creeperkeeper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultUserAgent is sent with requests unless another is configured.
+const DefaultUserAgent = "creeperkeeper (+https://github.com/torbiak/creeperkeeper)"
+
+// ClientConfig describes an HTTP client for NewClient.
+type ClientConfig struct {
+	// ConnectTimeout limits how long establishing a connection, including
+	// the TLS handshake, can take. Zero means no limit.
+	ConnectTimeout time.Duration
+	// Timeout limits how long each request can take, including reading the
+	// response body. Video downloads that time out are resumed when they're
+	// retried. Zero means no limit.
+	Timeout time.Duration
+	// UserAgent is sent with every request. If empty, DefaultUserAgent is
+	// used.
+	UserAgent string
+	// Proxy is the URL of an HTTP, HTTPS, or SOCKS5 proxy. If empty, the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used,
+	// and "direct" disables proxying altogether.
+	Proxy string
+	// CAFile is a file of PEM-encoded certificates that are trusted in
+	// addition to the system's roots, such as an intercepting proxy's.
+	CAFile string
+	// Header holds extra headers sent with every request.
+	Header http.Header
+}
+
+// DefaultClientConfig is the configuration of the initial Client.
+var DefaultClientConfig = ClientConfig{
+	ConnectTimeout: 30 * time.Second,
+	Timeout:        5 * time.Minute,
+}
+
+// Client is used for all HTTP requests, for both metadata and videos.
+var Client = func() *http.Client {
+	c, err := NewClient(DefaultClientConfig)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}()
+
+// NewClient returns an HTTP client configured according to cfg.
+func NewClient(cfg ClientConfig) (*http.Client, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t.DialContext = dialer.DialContext
+	t.TLSHandshakeTimeout = cfg.ConnectTimeout
+
+	switch cfg.Proxy {
+	case "":
+		t.Proxy = http.ProxyFromEnvironment
+	case "direct":
+		t.Proxy = nil
+	default:
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %s", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy %q: want an http, https, or socks5 URL", cfg.Proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+
+	if cfg.CAFile != "" {
+		pool, err := certPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	ua := cfg.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	return &http.Client{
+		Transport: &headerTransport{
+			base:      t,
+			userAgent: ua,
+			header:    cfg.Header,
+		},
+		Timeout: cfg.Timeout,
+	}, nil
+}
+
+// certPool returns the system's root certificates plus those in file.
+func certPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", file)
+	}
+	return pool, nil
+}
+
+// headerTransport adds a User-Agent and extra headers to requests that don't
+// already have them.
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	header    http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify the request they're given.
+	req = req.Clone(req.Context())
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	for k, v := range t.header {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = v
+		}
+	}
+	return t.base.RoundTrip(req)
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	crkr "github.com/torbiak/creeperkeeper"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
 	"text/template"
 	"time"
 )
@@ -18,114 +32,1545 @@ var nargsErr = fmt.Errorf("wrong number of arguments")
 
 type Cmd interface {
 	PrintUsage(io.Writer)
-	Run(args []string)
+	// Run runs the command. ctx is cancelled when crkr is interrupted.
+	Run(ctx context.Context, args []string)
 }
 
 type GetCmd struct {
-	flagSet   *flag.FlagSet
-	force     bool
-	noreverse bool
-	url       string
-	playlist  string
+	flagSet    *flag.FlagSet
+	net        netFlags
+	jobs       jobsFlags
+	progress   progressFlags
+	report     reportFlags
+	catalog    catalogFlags
+	cache      cacheFlags
+	force      bool
+	noreverse  bool
+	thumbnails bool
+	avatars    bool
+	noprobe    bool
+	filter     filterFlags
+	layout     layoutFlags
+	input      string
+	split      bool
+	urls       []string
+	playlist   string
+}
+
+func (c *GetCmd) PrintUsage(w io.Writer) {
+	usage := `get [<opts>] <url> <m3u_out>
+get [<opts>] -i <url_file> <m3u_out>
+  Download vines and metadata.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *GetCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("get", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.BoolVar(&c.force, "force", false, "overwrite video files")
+	c.flagSet.BoolVar(&c.noreverse, "noreverse", false, "write playlist in chronological order")
+	c.flagSet.BoolVar(&c.thumbnails, "thumbnails", false, "download thumbnail images")
+	c.flagSet.BoolVar(&c.avatars, "avatars", false, "download uploaders' avatars")
+	c.flagSet.BoolVar(&c.noprobe, "noprobe", false, "don't check downloaded videos with ffprobe")
+	c.flagSet.StringVar(&c.input, "i", "", "read URLs from `file`, one per line, or stdin if it's -")
+	c.flagSet.BoolVar(&c.split, "split", false, "write a playlist for each URL, named <m3u_out>.<name>.m3u")
+	c.filter.register(c.flagSet)
+	c.layout.register(c.flagSet)
+	c.net.register(c.flagSet)
+	c.jobs.register(c.flagSet, false)
+	c.progress.register(c.flagSet)
+	c.report.register(c.flagSet, true)
+	c.catalog.register(c.flagSet)
+	c.cache.register(c.flagSet)
+	return c.flagSet
+}
+
+func (c *GetCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
+	c.net.apply()
+	c.jobs.apply()
+	c.progress.apply()
+	c.cache.apply()
+	c.layout.apply()
+	c.report.start("get", args, c.playlist+".failures.json")
+
+	sources, err := crkr.ExtractAllVines(ctx, c.urls)
+	if err != nil {
+		log.Printf("get metadata: %s", err)
+	}
+	var vines []crkr.Vine
+	for _, src := range sources {
+		vines = append(vines, src...)
+	}
+	vines = crkr.DedupeVines(vines)
+	exitIfInterrupted(ctx, "got metadata for %d vines, downloaded none", len(vines))
+	vines = c.filter.filter().Apply(vines)
+	sortVines(vines, c.noreverse)
+	vines = crkr.LimitVines(vines, int(c.filter.offset), int(c.filter.limit))
+
+	nerrors := c.download(ctx, vines)
+	playlistVines := c.report.keep(vines)
+	if c.split {
+		nerrors += c.writeSplitPlaylists(sources, playlistVines)
+	} else {
+		err = writeM3U(c.playlist, playlistVines)
+		if err != nil {
+			nerrors++
+			c.report.fail("playlist", c.playlist, err)
+			log.Printf("write M3U: %s", err)
+		}
+	}
+	c.report.finish(nerrors)
+	if nerrors > 0 {
+		log.Fatal("error getting vines")
+	}
+}
+
+// download downloads vines and writes their metadata. It returns the number
+// of steps that had errors.
+func (c *GetCmd) download(ctx context.Context, vines []crkr.Vine) (nerrors int) {
+	opts := crkr.DownloadOptions{
+		Force:      c.force,
+		Thumbnails: c.thumbnails,
+		Avatars:    c.avatars,
+		Probe:      probeVideos(c.noprobe),
+	}
+	if err := crkr.DownloadVinesContext(ctx, vines, opts); err != nil {
+		nerrors++
+		c.report.fail("download", c.playlist, err)
+		log.Printf("download vines: %s", err)
+	}
+	c.report.report.AttachVines(vines)
+	exitIfInterrupted(ctx, "%d/%d videos downloaded", countExisting(videoFilenames(vines)), len(vines))
+
+	// Write metadata after downloading so it includes image paths.
+	if err := crkr.WriteAllVineMetadata(vines); err != nil {
+		nerrors++
+		c.report.fail("write-metadata", c.playlist, err)
+		log.Printf("write metadata: %s", err)
+	}
+	c.catalog.add(vines)
+	return nerrors
+}
+
+// retry gets the items that failed in a previous run, which was given args,
+// and adds them to its playlist.
+func (c *GetCmd) retry(ctx context.Context, prev *crkr.FailureReport, args []string) {
+	// Only the options and the playlist are needed, so the URL list isn't
+	// read again.
+	flags := c.flags()
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		log.Fatalf("retry: bad arguments in report: %q", args)
+	}
+	c.playlist = flags.Arg(flags.NArg() - 1)
+	c.net.apply()
+	c.jobs.apply()
+	c.progress.apply()
+	c.cache.apply()
+	c.layout.apply()
+	c.report.prev = prev
+	c.report.start("get", args, c.playlist+".failures.json")
+
+	var urls []string
+	var vines []crkr.Vine
+	nerrors := 0
+	for _, f := range prev.Failures {
+		switch {
+		case f.Stage == "extract":
+			urls = append(urls, f.ID)
+		case f.Stage == "metadata":
+			urls = append(urls, "https://vine.co/v/"+f.ID)
+		case f.Stage == "download" && f.Vine != nil:
+			vines = append(vines, *f.Vine)
+		case f.Stage == "playlist" && !c.split:
+			// The playlist is rewritten below.
+		default:
+			// Failures of whole steps, like writing metadata, can't be
+			// retried on their own, so they're kept in the report.
+			nerrors++
+			c.report.report.Record(crkr.Event{Kind: crkr.JobFailed, Stage: f.Stage, Job: f.ID, Err: f.Err})
+			log.Printf("can't retry %s for %s; run get again: %s", f.Stage, f.ID, f.Err)
+		}
+	}
+	sources, err := crkr.ExtractAllVines(ctx, urls)
+	if err != nil {
+		log.Printf("get metadata: %s", err)
+	}
+	for _, src := range sources {
+		vines = append(vines, c.filter.filter().Apply(src)...)
+	}
+	vines = crkr.DedupeVines(vines)
+	exitIfInterrupted(ctx, "got metadata for %d vines, downloaded none", len(vines))
+
+	nerrors += c.download(ctx, vines)
+	if c.split {
+		log.Printf("split playlists aren't updated by retry; run get again to rewrite them")
+	} else if err := c.addToPlaylist(c.report.keep(vines)); err != nil {
+		nerrors++
+		c.report.fail("playlist", c.playlist, err)
+		log.Printf("update M3U: %s", err)
+	}
+	c.report.finish(nerrors)
+	log.Printf("retried %d items, %d failed again", len(prev.Failures), c.report.count())
+	if nerrors > 0 {
+		log.Fatal("error getting vines")
+	}
+}
+
+// addToPlaylist adds vines to the playlist, keeping it sorted.
+func (c *GetCmd) addToPlaylist(vines []crkr.Vine) error {
+	existing, err := crkr.ReadMetadataForPlaylist(c.playlist)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	all := crkr.DedupeVines(append(existing, vines...))
+	sortVines(all, c.noreverse)
+	return writeM3U(c.playlist, all)
+}
+
+// writeSplitPlaylists writes a playlist for the vines from each source URL
+// that are also in vines, which have been filtered and downloaded, so the
+// playlists match the metadata. It returns the number of
+// playlists that couldn't be written.
+func (c *GetCmd) writeSplitPlaylists(sources [][]crkr.Vine, vines []crkr.Vine) (nerrors int) {
+	byUUID := make(map[string]crkr.Vine, len(vines))
+	for _, v := range vines {
+		byUUID[v.UUID] = v
+	}
+	names := splitPlaylistNames(c.playlist, c.urls)
+	for i, src := range sources {
+		if len(src) == 0 {
+			continue
+		}
+		// Leave out vines that were filtered out.
+		kept := []crkr.Vine{}
+		for _, v := range src {
+			if v, ok := byUUID[v.UUID]; ok {
+				kept = append(kept, v)
+			}
+		}
+		if len(kept) == 0 {
+			continue
+		}
+		src = kept
+		sortVines(src, c.noreverse)
+		err := writeM3U(names[i], src)
+		if err != nil {
+			nerrors++
+			c.report.fail("playlist", names[i], err)
+			log.Printf("write M3U for %s: %s", c.urls[i], err)
+		}
+	}
+	return nerrors
+}
+
+func (c *GetCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if c.input != "" {
+		if flags.NArg() != 1 {
+			return nargsErr
+		}
+		c.playlist = flags.Arg(0)
+		c.urls, err = readURLList(c.input)
+		if err != nil {
+			return fmt.Errorf("read URLs: %s", err)
+		}
+		if len(c.urls) == 0 {
+			return fmt.Errorf("no URLs in %s", c.input)
+		}
+		return nil
+	}
+	if flags.NArg() != 2 {
+		return nargsErr
+	}
+	c.urls = []string{flags.Arg(0)}
+	c.playlist = flags.Arg(1)
+	return nil
+}
+
+// readURLList reads URLs from a file, or stdin if name is "-".
+func readURLList(name string) ([]string, error) {
+	if name == "-" {
+		return crkr.ReadURLList(os.Stdin)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return crkr.ReadURLList(f)
+}
+
+var unsafeNameRE = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// splitPlaylistNames returns a playlist filename for each URL, based on
+// m3uOut and the last element of the URL's path, eg miel.m3u and
+// https://vine.co/u/56 give miel.56.m3u.
+func splitPlaylistNames(m3uOut string, urls []string) []string {
+	base := strings.TrimSuffix(m3uOut, filepath.Ext(m3uOut))
+	used := map[string]bool{}
+	names := make([]string, len(urls))
+	for i, rawurl := range urls {
+		name := ""
+		if u, err := url.Parse(rawurl); err == nil {
+			name = path.Base(strings.TrimRight(u.Path, "/"))
+		}
+		name = strings.Trim(unsafeNameRE.ReplaceAllString(name, "_"), "._")
+		if name == "" {
+			name = "source"
+		}
+		unique := name
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", name, n)
+		}
+		used[unique] = true
+		names[i] = fmt.Sprintf("%s.%s.m3u", base, unique)
+	}
+	return names
+}
+
+// netFlags are options shared by commands that make HTTP requests.
+type netFlags struct {
+	retries        int
+	retryWait      time.Duration
+	retryMaxWait   time.Duration
+	rate           float64
+	burst          int
+	bwlimit        int64
+	connectTimeout time.Duration
+	timeout        time.Duration
+	userAgent      string
+	proxy          string
+	caFile         string
+	header         headerFlag
+	config         string
+
+	fs *flag.FlagSet
+	// configurable are the names of the options that can be given in the
+	// config file.
+	configurable map[string]bool
+}
+
+func (n *netFlags) register(fs *flag.FlagSet) {
+	n.fs = fs
+	existing := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) { existing[f.Name] = true })
+	defer func() {
+		n.configurable = map[string]bool{}
+		fs.VisitAll(func(f *flag.Flag) {
+			if !existing[f.Name] && f.Name != "config" {
+				n.configurable[f.Name] = true
+			}
+		})
+	}()
+
+	fs.IntVar(&n.retries, "retries", crkr.Retry.MaxAttempts-1, "retry failed requests up to `n` times")
+	fs.DurationVar(&n.retryWait, "retry-wait", crkr.Retry.MinBackoff, "initial `duration` to wait before retrying a request")
+	fs.DurationVar(&n.retryMaxWait, "retry-max-wait", crkr.Retry.MaxBackoff, "maximum `duration` to wait before retrying a request")
+	fs.Float64Var(&n.rate, "rate", 0, "limit HTTP requests to `n` per second (0 for no limit)")
+	fs.IntVar(&n.burst, "burst", 1, "allow bursts of up to `n` requests when rate limiting")
+	fs.Int64Var(&n.bwlimit, "bwlimit", 0, "limit video downloads to `bytes` per second in total (0 for no limit)")
+	fs.DurationVar(&n.connectTimeout, "connect-timeout", crkr.DefaultClientConfig.ConnectTimeout, "give up connecting after `duration` (0 for no limit)")
+	fs.DurationVar(&n.timeout, "timeout", crkr.DefaultClientConfig.Timeout, "give up on a request after `duration`, including reading the response (0 for no limit)")
+	fs.StringVar(&n.userAgent, "user-agent", crkr.DefaultUserAgent, "send `string` as the User-Agent header")
+	fs.StringVar(&n.proxy, "proxy", "", "send requests through the proxy at `url` (http, https, or socks5), or \"direct\" to ignore HTTP_PROXY etc")
+	fs.StringVar(&n.caFile, "ca-file", "", "trust the PEM certificates in `file` in addition to the system's")
+	fs.Var(&n.header, "header", "send `\"name: value\"` with every request. Can be repeated.")
+	fs.StringVar(&n.config, "config", defaultConfigFile(), "read defaults for network options from `file`")
+}
+
+// apply configures the crkr package according to the flags.
+func (n *netFlags) apply() {
+	err := n.readConfig()
+	if err != nil {
+		log.Fatalf("read config: %s", err)
+	}
+	client, err := crkr.NewClient(crkr.ClientConfig{
+		ConnectTimeout: n.connectTimeout,
+		Timeout:        n.timeout,
+		UserAgent:      n.userAgent,
+		Proxy:          n.proxy,
+		CAFile:         n.caFile,
+		Header:         n.header.h,
+	})
+	if err != nil {
+		log.Fatalf("http client: %s", err)
+	}
+	crkr.Client = client
+	crkr.Retry = crkr.RetryPolicy{
+		MaxAttempts: n.retries + 1,
+		MinBackoff:  n.retryWait,
+		MaxBackoff:  n.retryMaxWait,
+	}
+	if !(n.rate >= 0) {
+		log.Fatalf("-rate: want a non-negative number of requests per second, got %v", n.rate)
+	}
+	if n.bwlimit < 0 {
+		log.Fatalf("-bwlimit: want a non-negative number of bytes per second, got %d", n.bwlimit)
+	}
+	crkr.RequestLimiter = crkr.NewRateLimiter(n.rate, n.burst)
+	crkr.BandwidthLimiter = nil
+	if n.bwlimit > 0 {
+		// Allow a tenth of a second's worth of data at once so reads
+		// aren't too choppy.
+		burst := n.bwlimit / 10
+		if burst > 1<<20 {
+			burst = 1 << 20
+		}
+		crkr.BandwidthLimiter = crkr.NewRateLimiter(float64(n.bwlimit), int(burst))
+	}
+}
+
+// readConfig sets network options that weren't given on the command line from
+// the config file. Each line of the file has an option's name, without the
+// dash, followed by whitespace and its value. Blank lines and lines starting
+// with # are ignored. It's fine for the default config file not to exist.
+func (n *netFlags) readConfig() error {
+	given := map[string]bool{}
+	n.fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	if n.config == "" {
+		return nil
+	}
+	f, err := os.Open(n.config)
+	if os.IsNotExist(err) && !given["config"] {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i:])
+		}
+		if !n.configurable[name] {
+			return fmt.Errorf("%s:%d: unknown option %q", n.config, lineno, name)
+		}
+		if given[name] {
+			continue
+		}
+		err := n.fs.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %s", n.config, lineno, value, name, err)
+		}
+	}
+	return s.Err()
+}
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "crkr", "config")
+}
+
+// headerFlag is a flag.Value that accumulates HTTP headers.
+type headerFlag struct {
+	h http.Header
+}
+
+func (f *headerFlag) String() string {
+	if f.h == nil {
+		return ""
+	}
+	b := &strings.Builder{}
+	f.h.Write(b)
+	return strings.TrimSpace(b.String())
+}
+
+func (f *headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("bad header %q: want \"name: value\"", s)
+	}
+	if f.h == nil {
+		f.h = http.Header{}
+	}
+	f.h.Add(strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// jobsFlags are options for how much work is done at once. -j sets the limit
+// for every kind of job, and the others override it for one kind.
+type jobsFlags struct {
+	all      int
+	download int
+	meta     int
+	encode   int
+}
+
+// register adds -j and the options for either encoding or fetching, since no
+// command does both.
+func (j *jobsFlags) register(fs *flag.FlagSet, encode bool) {
+	fs.IntVar(&j.all, "j", 0, "run up to `n` jobs of each kind at once (0 for the defaults)")
+	if encode {
+		fs.IntVar(&j.encode, "encode-jobs", 0, fmt.Sprintf("run up to `n` ffmpeg processes at once (default -j or %d)", crkr.DefaultConcurrency.Encode))
+		return
+	}
+	fs.IntVar(&j.download, "download-jobs", 0, fmt.Sprintf("download up to `n` vines at once (default -j or %d)", crkr.DefaultConcurrency.Download))
+	fs.IntVar(&j.meta, "meta-jobs", 0, fmt.Sprintf("fetch metadata for up to `n` vines at once (default -j or %d)", crkr.DefaultConcurrency.Metadata))
+}
+
+// apply configures the crkr package according to the flags.
+func (j *jobsFlags) apply() {
+	jobs := crkr.DefaultConcurrency
+	if j.all > 0 {
+		jobs = crkr.Concurrency{Download: j.all, Metadata: j.all, Encode: j.all}
+	}
+	if j.download > 0 {
+		jobs.Download = j.download
+	}
+	if j.meta > 0 {
+		jobs.Metadata = j.meta
+	}
+	if j.encode > 0 {
+		jobs.Encode = j.encode
+	}
+	crkr.Jobs = jobs
+}
+
+// reportFlags are options for the report of items that failed, which the
+// retry command reads.
+type reportFlags struct {
+	file    string
+	exclude bool
+
+	report *crkr.FailureReport
+	// prev is the report being retried, if any.
+	prev *crkr.FailureReport
+}
+
+func (r *reportFlags) register(fs *flag.FlagSet, exclude bool) {
+	fs.StringVar(&r.file, "report", "", "write a JSON report of the items that failed to `file`, for the retry command (default <m3u_out>.failures.json)")
+	if exclude {
+		fs.BoolVar(&r.exclude, "exclude-failed", false, "leave vines that failed to download out of playlists")
+	}
+}
+
+// start records failures while the command runs. The report is written to
+// defaultFile if -report wasn't given.
+func (r *reportFlags) start(command string, args []string, defaultFile string) {
+	if r.file == "" {
+		r.file = defaultFile
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The working directory might be changed later.
+	if !filepath.IsAbs(r.file) {
+		r.file = filepath.Join(dir, r.file)
+	}
+	r.report = &crkr.FailureReport{
+		Command: command,
+		Args:    args,
+		Dir:     dir,
+		Time:    time.Now().UTC().Truncate(time.Second),
+	}
+	progress := crkr.Progress
+	crkr.Progress = func(e crkr.Event) {
+		if progress != nil {
+			progress(e)
+		}
+		r.report.Record(e)
+	}
+	// An interrupted run is incomplete, so it mustn't remove an old report.
+	onExit = func() { r.finish(1) }
+}
+
+// fail records the failure of a step that isn't a job, such as writing a
+// playlist. id is what the step was working on, eg the playlist's filename.
+// Errors for batches of jobs are ignored, since each job that failed has
+// already been recorded.
+func (r *reportFlags) fail(stage, id string, err error) {
+	var batchErr *crkr.BatchError
+	if r.report == nil || errors.As(err, &batchErr) {
+		return
+	}
+	r.report.Record(crkr.Event{Kind: crkr.JobFailed, Stage: stage, Job: id, Err: err.Error()})
+}
+
+// finish writes the report if anything failed. Otherwise any report left by
+// an earlier run is removed, unless the command had nerrors errors that
+// weren't recorded, since the old report might be all that's left of what
+// needs to be done.
+func (r *reportFlags) finish(nerrors int) {
+	if r.report == nil {
+		return
+	}
+	n := r.count()
+	if n == 0 && nerrors > 0 {
+		return
+	}
+	if n == 0 {
+		err := os.Remove(r.file)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("remove old failure report: %s", err)
+		}
+		return
+	}
+	if r.prev != nil {
+		r.report.CountAttempts(r.prev)
+	}
+	err := r.report.Write(r.file)
+	if err != nil {
+		log.Printf("write failure report: %s", err)
+		return
+	}
+	log.Printf("%d items failed; retry them with: crkr retry %s", n, r.file)
+}
+
+func (r *reportFlags) count() int {
+	if r.report == nil {
+		return 0
+	}
+	return len(r.report.Failures)
+}
+
+// keep returns the vines that should be in playlists: all of them, unless
+// -exclude-failed was given, in which case vines that couldn't be
+// downloaded or imported are left out.
+func (r *reportFlags) keep(vines []crkr.Vine) []crkr.Vine {
+	if !r.exclude || r.report == nil {
+		return vines
+	}
+	kept := []crkr.Vine{}
+	for _, v := range vines {
+		if r.report.Failed("download", v.UUID) || r.report.Failed("import", v.UUID) {
+			continue
+		}
+		kept = append(kept, v)
+	}
+	return kept
+}
+
+// filterFlags are options for choosing which vines to get.
+type filterFlags struct {
+	since, until   dateFlag
+	match, exclude regexpFlag
+	uploader       string
+	hashtag        string
+	minLoops       int64
+	minLikes       int64
+	offset, limit  countFlag
+}
+
+func (f *filterFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.since, "since", "only get vines created on or after `date` (YYYY-MM-DD or RFC 3339)")
+	fs.Var(&f.until, "until", "only get vines created before the end of `date` (YYYY-MM-DD or RFC 3339)")
+	fs.Var(&f.match, "match", "only get vines with titles matching `regexp`")
+	fs.Var(&f.exclude, "exclude", "skip vines with titles matching `regexp`")
+	fs.StringVar(&f.uploader, "uploader", "", "only get vines uploaded by `user` (name or ID), skipping reposts")
+	fs.StringVar(&f.hashtag, "hashtag", "", "only get vines tagged with `tag`")
+	fs.Int64Var(&f.minLoops, "min-loops", 0, "only get vines with at least `n` loops")
+	fs.Int64Var(&f.minLikes, "min-likes", 0, "only get vines with at least `n` likes")
+	fs.Var(&f.offset, "offset", "skip the first `n` vines, after sorting")
+	fs.Var(&f.limit, "limit", "get at most `n` vines, after sorting (0 for no limit)")
+}
+
+func (f *filterFlags) filter() crkr.Filter {
+	filter := crkr.Filter{
+		Since:    f.since.t,
+		Match:    f.match.re,
+		Exclude:  f.exclude.re,
+		Uploader: f.uploader,
+		Hashtag:  f.hashtag,
+		MinLoops: f.minLoops,
+		MinLikes: f.minLikes,
+	}
+	filter.Until = f.until.t
+	if f.until.dateOnly {
+		// Include the whole day.
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+// dateFlag is a flag.Value for a date or time.
+type dateFlag struct {
+	t        time.Time
+	dateOnly bool
+}
+
+func (d *dateFlag) String() string {
+	if d.t.IsZero() {
+		return ""
+	}
+	if d.dateOnly {
+		return d.t.Format("2006-01-02")
+	}
+	return d.t.Format(time.RFC3339)
+}
+
+func (d *dateFlag) Set(s string) error {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		d.t, d.dateOnly = t, true
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("bad date %q: want YYYY-MM-DD or RFC 3339", s)
+	}
+	d.t, d.dateOnly = t, false
+	return nil
+}
+
+// countFlag is a flag.Value for a number of items, which can't be negative.
+type countFlag int
+
+func (c *countFlag) String() string {
+	return strconv.Itoa(int(*c))
+}
+
+func (c *countFlag) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("bad number %q", s)
+	}
+	if n < 0 {
+		return fmt.Errorf("want a non-negative number, got %d", n)
+	}
+	*c = countFlag(n)
+	return nil
+}
+
+// regexpFlag is a flag.Value for a regular expression.
+type regexpFlag struct {
+	re *regexp.Regexp
+}
+
+func (r *regexpFlag) String() string {
+	if r.re == nil {
+		return ""
+	}
+	return r.re.String()
+}
+
+func (r *regexpFlag) Set(s string) error {
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	r.re = re
+	return nil
+}
+
+// cacheFlags are options for commands that fetch API responses, which are
+// cached, and resolve vanity profile URLs, which uses the cache directory to
+// remember names it has seen.
+type cacheFlags struct {
+	dir      string
+	noCache  bool
+	vanities string
+}
+
+func (c *cacheFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.dir, "cache-dir", defaultCacheDir(), "cache API responses in `dir`")
+	fs.BoolVar(&c.noCache, "no-cache", false, "don't use the API response cache")
+	fs.StringVar(&c.vanities, "vanities", "", "resolve vanity profile URLs using `file`, with a name and user ID on each line")
+}
+
+// apply configures the crkr package according to the flags. Failing to
+// create the cache isn't fatal.
+func (c *cacheFlags) apply() {
+	crkr.Vanities = []crkr.VanityResolver{crkr.ArchiveVanities{}}
+	if c.vanities != "" {
+		m, err := crkr.ReadVanityFile(c.vanities)
+		if err != nil {
+			log.Fatalf("read vanities: %s", err)
+		}
+		crkr.Vanities = append(crkr.Vanities, m)
+	}
+
+	crkr.Cache = nil
+	crkr.LearnedVanities = nil
+	if c.noCache || c.dir == "" {
+		return
+	}
+	cache, err := crkr.NewHTTPCache(c.dir)
+	if err != nil {
+		log.Printf("not caching: %s", err)
+		return
+	}
+	crkr.Cache = cache
+	learned, err := crkr.OpenVanityCache(filepath.Join(c.dir, "vanities.json"))
+	if err != nil {
+		log.Printf("not learning vanity names: %s", err)
+		return
+	}
+	crkr.LearnedVanities = learned
+}
+
+func defaultCacheDir() string {
+	dir, err := crkr.DefaultCacheDir()
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// sortVines sorts vines newest-first, or oldest-first if noreverse is true.
+func sortVines(vines []crkr.Vine, noreverse bool) {
+	if noreverse {
+		sort.Sort(crkr.ByCreated(vines))
+	} else {
+		sort.Sort(sort.Reverse(crkr.ByCreated(vines)))
+	}
+}
+
+func writeM3U(m3uFile string, vines []crkr.Vine) error {
+	return crkr.WriteM3UFile(m3uFile, vines)
+}
+
+// catalogFlags are options for the catalog of downloaded vines.
+type catalogFlags struct {
+	file      string
+	noCatalog bool
+}
+
+func (c *catalogFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.file, "catalog", defaultCatalogFile(), "keep a catalog of downloaded vines in `file`")
+	fs.BoolVar(&c.noCatalog, "no-catalog", false, "don't update the catalog")
+}
+
+// add adds the vines whose videos exist to the catalog. Failing to update it
+// isn't fatal.
+func (c *catalogFlags) add(vines []crkr.Vine) {
+	if c.noCatalog || c.file == "" {
+		return
+	}
+	present := []crkr.Vine{}
+	for _, v := range vines {
+		if crkr.FileExists(v.VideoFilename()) {
+			present = append(present, v)
+		}
+	}
+	err := crkr.UpdateCatalog(c.file, func(cat *crkr.Catalog) error {
+		return cat.Add(present)
+	})
+	if err != nil {
+		log.Printf("update catalog: %s", err)
+	}
+}
+
+// refresh updates the subtitle state of videos in the catalog.
+func (c *catalogFlags) refresh(videos []string) {
+	if c.noCatalog || c.file == "" {
+		return
+	}
+	err := crkr.UpdateCatalog(c.file, func(cat *crkr.Catalog) error {
+		return cat.Refresh(videos)
+	})
+	if err != nil {
+		log.Printf("update catalog: %s", err)
+	}
+}
+
+func defaultCatalogFile() string {
+	file, err := crkr.DefaultCatalogFile()
+	if err != nil {
+		return ""
+	}
+	return file
+}
+
+// layoutFlags are options for where downloaded files are written.
+type layoutFlags struct {
+	dir     string
+	pattern string
+}
+
+func (l *layoutFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&l.dir, "dir", "", "write files under `dir`")
+	fs.StringVar(&l.pattern, "pattern", crkr.DefaultPattern, "filename `template`, without an extension. See README for details.")
+}
+
+// apply configures the crkr package according to the flags.
+func (l *layoutFlags) apply() {
+	layout, err := crkr.NewLayout(l.dir, l.pattern)
+	if err != nil {
+		log.Fatalf("filename pattern: %s", err)
+	}
+	crkr.Output = layout
+}
+
+type SyncCmd struct {
+	flagSet    *flag.FlagSet
+	net        netFlags
+	jobs       jobsFlags
+	progress   progressFlags
+	report     reportFlags
+	catalog    catalogFlags
+	cache      cacheFlags
+	noreverse  bool
+	thumbnails bool
+	avatars    bool
+	noprobe    bool
+	playlist   string
+	url        string
+	dir        string
+}
+
+func (c *SyncCmd) PrintUsage(w io.Writer) {
+	usage := `sync [<opts>] <url> <dir>
+  Download a user's new vines into dir and add them to its playlist.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *SyncCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("sync", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.StringVar(&c.playlist, "playlist", "vines.m3u", "playlist `file` in dir")
+	c.flagSet.BoolVar(&c.noreverse, "noreverse", false, "add new vines to the end of the playlist")
+	c.flagSet.BoolVar(&c.thumbnails, "thumbnails", false, "download thumbnail images")
+	c.flagSet.BoolVar(&c.avatars, "avatars", false, "download uploaders' avatars")
+	c.flagSet.BoolVar(&c.noprobe, "noprobe", false, "don't check downloaded videos with ffprobe")
+	c.net.register(c.flagSet)
+	c.jobs.register(c.flagSet, false)
+	c.progress.register(c.flagSet)
+	c.report.register(c.flagSet, false)
+	c.catalog.register(c.flagSet)
+	c.cache.register(c.flagSet)
+	return c.flagSet
+}
+
+func (c *SyncCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
+	c.net.apply()
+	c.jobs.apply()
+	c.progress.apply()
+	c.cache.apply()
+	c.report.start("sync", args, filepath.Join(c.dir, "crkr-failures.json"))
+
+	// Files are named relative to the working directory.
+	err = os.MkdirAll(c.dir, 0777)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.Chdir(c.dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manifest, err := crkr.ReadManifest(crkr.ManifestFilename)
+	if os.IsNotExist(err) {
+		manifest = &crkr.Manifest{URL: c.url}
+	} else if err != nil {
+		log.Fatalf("read manifest: %s", err)
+	}
+	manifest.URL = c.url
+
+	nerrors := 0
+	plan, err := manifest.Plan(ctx)
+	if err != nil {
+		nerrors++
+		c.report.fail("profile", c.url, err)
+		log.Printf("get metadata: %s", err)
+		if plan.New == nil && plan.Gone == nil {
+			c.report.finish(nerrors)
+			log.Fatal("error syncing vines")
+		}
+	}
+	exitIfInterrupted(ctx, "got metadata for %d new vines, downloaded none", len(plan.New))
+	reportGone(manifest.Gone, plan.Gone)
+	manifest.Gone = plan.Gone
+	sortVines(plan.New, c.noreverse)
+
+	opts := crkr.DownloadOptions{
+		Thumbnails: c.thumbnails,
+		Avatars:    c.avatars,
+		Probe:      probeVideos(c.noprobe),
+	}
+	if err := crkr.DownloadVinesContext(ctx, plan.New, opts); err != nil {
+		nerrors++
+		c.report.fail("download", c.playlist, err)
+		log.Printf("download vines: %s", err)
+	}
+	// Only vines that were downloaded are marked as synced, so the rest are
+	// tried again next time.
+	synced := []crkr.Vine{}
+	for _, v := range plan.New {
+		if crkr.FileExists(v.VideoFilename()) {
+			synced = append(synced, v)
+		}
+	}
+
+	if err := crkr.WriteAllVineMetadata(synced); err != nil {
+		nerrors++
+		c.report.fail("write-metadata", c.playlist, err)
+		log.Printf("write metadata: %s", err)
+	}
+	c.catalog.add(synced)
+	if err := updateM3U(c.playlist, synced, !c.noreverse); err != nil {
+		nerrors++
+		c.report.fail("playlist", c.playlist, err)
+		log.Printf("update M3U: %s", err)
+	}
+	manifest.Add(synced)
+	manifest.Synced = time.Now().UTC().Truncate(time.Second)
+	if err := manifest.Write(crkr.ManifestFilename); err != nil {
+		nerrors++
+		c.report.fail("manifest", crkr.ManifestFilename, err)
+		log.Printf("write manifest: %s", err)
+	}
+	log.Printf("synced %d/%d new vines, %d gone", len(synced), len(plan.New), len(plan.Gone))
+	exitIfInterrupted(ctx, "synced %d/%d new vines", len(synced), len(plan.New))
+	c.report.finish(nerrors)
+	if nerrors > 0 {
+		log.Fatal("error syncing vines")
+	}
+}
+
+func (c *SyncCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return nargsErr
+	}
+	c.url = flags.Arg(0)
+	c.dir = flags.Arg(1)
+	return nil
+}
+
+// reportGone logs posts that have disappeared from a profile since the last
+// sync.
+func reportGone(before, after []string) {
+	known := map[string]bool{}
+	for _, id := range before {
+		known[id] = true
+	}
+	for _, id := range after {
+		if !known[id] {
+			log.Printf("post %s is no longer in the profile", id)
+		}
+	}
+}
+
+// updateM3U adds vines to a playlist, creating it if necessary, without
+// disturbing the order of the existing entries.
+func updateM3U(m3uFile string, vines []crkr.Vine, prepend bool) error {
+	in, err := os.Open(m3uFile)
+	if os.IsNotExist(err) {
+		in, err = os.Open(os.DevNull)
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(m3uFile), "tmp_playlist")
+	if err != nil {
+		return err
+	}
+	err = crkr.UpdateM3U(out, in, vines, prepend)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), m3uFile)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+	return err
+}
+
+type ImportArchiveCmd struct {
+	flagSet    *flag.FlagSet
+	net        netFlags
+	jobs       jobsFlags
+	progress   progressFlags
+	report     reportFlags
+	catalog    catalogFlags
+	force      bool
+	noreverse  bool
+	nodownload bool
+	noprobe    bool
+	layout     layoutFlags
+	user       string
+	archive    string
+	playlist   string
+}
+
+func (c *ImportArchiveCmd) PrintUsage(w io.Writer) {
+	usage := `import-archive [<opts>] <dir|tarball> <m3u_out>
+  Import vines and metadata from a local copy of archive.vine.co.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *ImportArchiveCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("import-archive", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.BoolVar(&c.force, "force", false, "overwrite video files")
+	c.flagSet.BoolVar(&c.noreverse, "noreverse", false, "write playlist in chronological order")
+	c.flagSet.BoolVar(&c.nodownload, "nodownload", false, "don't download videos missing from the archive")
+	c.flagSet.BoolVar(&c.noprobe, "noprobe", false, "don't check imported videos with ffprobe")
+	c.flagSet.StringVar(&c.user, "user", "", "only import posts by the user with this numeric `id`")
+	c.layout.register(c.flagSet)
+	c.net.register(c.flagSet)
+	c.jobs.register(c.flagSet, false)
+	c.progress.register(c.flagSet)
+	c.report.register(c.flagSet, true)
+	c.catalog.register(c.flagSet)
+	return c.flagSet
+}
+
+func (c *ImportArchiveCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
+	c.net.apply()
+	c.jobs.apply()
+	c.progress.apply()
+	c.layout.apply()
+	c.report.start("import-archive", args, c.playlist+".failures.json")
+
+	archive, err := crkr.OpenArchive(c.archive)
+	if err != nil {
+		log.Fatalf("open archive: %s", err)
+	}
+
+	var vines []crkr.Vine
+	if c.user != "" {
+		vines, err = archive.UserVines(c.user)
+	} else {
+		vines, err = archive.AllVines()
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	sortVines(vines, c.noreverse)
+
+	nerrors := 0
+
+	// Indexes into vines of the videos to import.
+	imports := []int{}
+	for i, v := range vines {
+		if !c.force && crkr.FileExists(v.VideoFilename()) {
+			crkr.KeepChecksum(&vines[i])
+			continue
+		}
+		imports = append(imports, i)
+	}
+	toImport := make([]crkr.Vine, len(imports))
+	for i, j := range imports {
+		toImport[i] = vines[j]
+	}
+	imported, err := archive.ImportVideos(ctx, toImport, !c.nodownload, probeVideos(c.noprobe))
+	if err != nil {
+		nerrors++
+		c.report.fail("import", c.playlist, err)
+		log.Printf("import videos: %s", err)
+	}
+	for i, j := range imports {
+		vines[j] = imported[i]
+	}
+	if ctx.Err() != nil {
+		archive.Close()
+		exitIfInterrupted(ctx, "%d/%d videos imported", countExisting(videoFilenames(vines)), len(vines))
+	}
+
+	// Write metadata after importing so it includes checksums.
+	if err := crkr.WriteAllVineMetadata(vines); err != nil {
+		nerrors++
+		c.report.fail("write-metadata", c.playlist, err)
+		log.Printf("write metadata: %s", err)
+	}
+	c.catalog.add(vines)
+	err = writeM3U(c.playlist, c.report.keep(vines))
+	if err != nil {
+		nerrors++
+		c.report.fail("playlist", c.playlist, err)
+		log.Printf("write M3U: %s", err)
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("close archive: %s", err)
+	}
+	c.report.finish(nerrors)
+	if nerrors > 0 {
+		log.Fatal("error importing vines")
+	}
 }
 
-func (c *GetCmd) PrintUsage(w io.Writer) {
-	usage := `get <url> <m3u_out>
-  Download vines and metadata.`
+func (c *ImportArchiveCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return nargsErr
+	}
+	c.archive = flags.Arg(0)
+	c.playlist = flags.Arg(1)
+	return nil
+}
+
+type CacheCmd struct {
+	flagSet *flag.FlagSet
+	dir     string
+	age     time.Duration
+}
+
+func (c *CacheCmd) PrintUsage(w io.Writer) {
+	usage := `cache prune [<opts>]
+  Remove old API responses from the cache.`
 	printCmdUsage(w, usage, c.flags())
 }
 
-func (c *GetCmd) flags() *flag.FlagSet {
+func (c *CacheCmd) flags() *flag.FlagSet {
 	if c.flagSet != nil {
 		return c.flagSet
 	}
-	c.flagSet = flag.NewFlagSet("get", flag.ContinueOnError)
+	c.flagSet = flag.NewFlagSet("cache", flag.ContinueOnError)
 	c.flagSet.SetOutput(ioutil.Discard)
-	c.flagSet.BoolVar(&c.force, "force", false, "overwrite video files")
-	c.flagSet.BoolVar(&c.noreverse, "noreverse", false, "write playlist in chronological order")
+	c.flagSet.StringVar(&c.dir, "cache-dir", defaultCacheDir(), "cache `dir`")
+	c.flagSet.DurationVar(&c.age, "age", 0, "only remove responses that haven't been used for `duration` (0 removes all)")
 	return c.flagSet
 }
 
-func (c *GetCmd) Run(args []string) {
-	err := c.parseArgs(args)
+func (c *CacheCmd) Run(ctx context.Context, args []string) {
+	if len(args) == 0 || args[0] != "prune" {
+		fatalCmdUsage(c, fmt.Errorf("unknown or missing cache command"))
+	}
+	flags := c.flags()
+	err := flags.Parse(args[1:])
 	if err != nil {
 		fatalCmdUsage(c, err)
 	}
-
-	vines, err := crkr.ExtractVines(c.url)
+	if flags.NArg() != 0 {
+		fatalCmdUsage(c, nargsErr)
+	}
+	if c.dir == "" {
+		log.Fatal("no cache dir")
+	}
+	if !crkr.FileExists(c.dir) {
+		return
+	}
+	cache := &crkr.HTTPCache{Dir: c.dir}
+	removed, err := cache.Prune(c.age)
+	if crkr.Verbose {
+		log.Printf("removed %d cache entries", removed)
+	}
 	if err != nil {
-		log.Print(err)
+		log.Fatal(err)
 	}
-	if c.noreverse {
-		sort.Sort(crkr.ByCreated(vines))
-	} else {
-		sort.Sort(sort.Reverse(crkr.ByCreated(vines)))
+}
+
+type VerifyCmd struct {
+	flagSet  *flag.FlagSet
+	noprobe  bool
+	playlist string
+}
+
+func (c *VerifyCmd) PrintUsage(w io.Writer) {
+	usage := `verify [<opts>] <m3u>
+  Check videos against the sizes and checksums recorded when they were
+  downloaded, and list missing or corrupt ones.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *VerifyCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
 	}
+	c.flagSet = flag.NewFlagSet("verify", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.BoolVar(&c.noprobe, "noprobe", false, "don't check videos with ffprobe")
+	return c.flagSet
+}
 
-	nerrors := 0
+func (c *VerifyCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
 
-	if err := crkr.WriteAllVineMetadata(vines); err != nil {
+	nerrors := 0
+	vines, err := crkr.ReadMetadataForPlaylist(c.playlist)
+	if err != nil {
 		nerrors++
-		log.Printf("write metadata: %s", err)
+		log.Printf("read metadata: %s", err)
 	}
-
-	download := []crkr.Vine{}
-	if c.force {
-		download = vines
-	} else {
-		for _, v := range vines {
-			if crkr.FileExists(v.VideoFilename()) {
-				continue
-			}
-			download = append(download, v)
+	// Vines whose metadata couldn't be read are zero.
+	checks := []crkr.Vine{}
+	for _, v := range vines {
+		if v.UUID != "" {
+			checks = append(checks, v)
 		}
 	}
 
-	if err := crkr.DownloadVines(download); err != nil {
-		nerrors++
-		log.Printf("download vines: %s", err)
+	problems, err := crkr.CheckVideos(ctx, checks, probeVideos(c.noprobe))
+	for _, p := range problems {
+		fmt.Println(p)
 	}
+	exitIfInterrupted(ctx, "%d problems found so far", len(problems))
+	if crkr.Verbose {
+		log.Printf("%d/%d videos ok", len(checks)-len(problems), len(checks))
+	}
+	if len(problems) > 0 || nerrors > 0 {
+		os.Exit(1)
+	}
+}
 
-	err = writeM3U(c.playlist, vines)
+func (c *VerifyCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
 	if err != nil {
-		nerrors++
-		log.Printf("write M3U: %s", err)
+		return err
 	}
-	if nerrors > 0 {
-		log.Fatal("error getting vines")
+	if flags.NArg() != 1 {
+		return nargsErr
 	}
+	c.playlist = flags.Arg(0)
+	return nil
 }
 
-func (c *GetCmd) parseArgs(args []string) error {
+type QueryCmd struct {
+	flagSet   *flag.FlagSet
+	catalog   string
+	filter    filterFlags
+	subtitled bool
+	sort      string
+	format    string
+	out       string
+}
+
+func (c *QueryCmd) PrintUsage(w io.Writer) {
+	usage := `query [<opts>]
+  List vines in the catalog, which get, sync and import-archive add to.
+  With -format m3u a playlist is written, to stdout or the -o file.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *QueryCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("query", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.StringVar(&c.catalog, "catalog", defaultCatalogFile(), "read the catalog from `file`")
+	c.flagSet.BoolVar(&c.subtitled, "subtitled", false, "only list vines with rendered subtitles")
+	c.flagSet.StringVar(&c.sort, "sort", "-created", "sort by `field`: "+strings.Join(crkr.SortFields, ", ")+". A leading - sorts in descending order")
+	c.flagSet.StringVar(&c.format, "format", "table", "output `format`: table, json, or m3u")
+	c.flagSet.StringVar(&c.out, "o", "", "write output to `file` instead of stdout")
+	c.filter.register(c.flagSet)
+	return c.flagSet
+}
+
+func (c *QueryCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
+	cat, err := crkr.ReadCatalog(c.catalog)
+	if err != nil {
+		log.Fatalf("read catalog: %s", err)
+	}
+	entries, err := cat.Query(crkr.CatalogQuery{
+		Filter:    c.filter.filter(),
+		Subtitled: c.subtitled,
+		Sort:      c.sort,
+		Offset:    int(c.filter.offset),
+		Limit:     int(c.filter.limit),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if c.format == "m3u" && c.out != "" {
+		// Paths are relative to the playlist.
+		err = writeM3U(c.out, crkr.CatalogVines(entries))
+		if err != nil {
+			log.Fatalf("write M3U: %s", err)
+		}
+		return
+	}
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if c.out != "" {
+		f, err = os.Create(c.out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w = f
+	}
+	switch c.format {
+	case "m3u":
+		err = crkr.WriteM3U(w, crkr.CatalogVines(entries))
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(entries)
+	default:
+		err = writeCatalogTable(w, entries)
+	}
+	if f != nil {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (c *QueryCmd) parseArgs(args []string) error {
 	flags := c.flags()
 	err := flags.Parse(args)
 	if err != nil {
 		return err
 	}
-	if flags.NArg() != 2 {
+	if flags.NArg() != 0 {
 		return nargsErr
 	}
-	c.url = flags.Arg(0)
-	c.playlist = flags.Arg(1)
+	switch c.format {
+	case "table", "json", "m3u":
+	default:
+		return fmt.Errorf("-format: want table, json, or m3u, got %q", c.format)
+	}
 	return nil
 }
 
-func writeM3U(m3uFile string, vines []crkr.Vine) (err error) {
-	f, err := os.Create(m3uFile)
+// writeCatalogTable lists catalog entries with a line for each.
+func writeCatalogTable(w io.Writer, entries []crkr.CatalogEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tUPLOADER\tLOOPS\tLIKES\tSUBS\tVIDEO\tTITLE")
+	for _, e := range entries {
+		subs := "-"
+		if e.Subtitled != "" {
+			subs = "rendered"
+		} else if e.Subtitles != "" {
+			subs = "srt"
+		}
+		title := strings.Join(strings.Fields(e.Title), " ")
+		if r := []rune(title); len(r) > 50 {
+			title = string(r[:49]) + "…"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			e.Created.Format("2006-01-02"), e.Uploader, e.Loops, e.Likes, subs, e.Video, title)
+	}
+	return tw.Flush()
+}
+
+type MigrateCmd struct {
+	flagSet *flag.FlagSet
+	strict  bool
+	target  string
+}
+
+func (c *MigrateCmd) PrintUsage(w io.Writer) {
+	usage := `migrate [<opts>] <m3u|dir>
+  Rewrite metadata files written by older versions of crkr in the current
+  format, for the vines in a playlist or in a directory and its
+  subdirectories.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *MigrateCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("migrate", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	c.flagSet.BoolVar(&c.strict, "strict", false, "also fail on files in the current format that have unknown fields")
+	return c.flagSet
+}
+
+func (c *MigrateCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
 	if err != nil {
-		return err
+		fatalCmdUsage(c, err)
 	}
-	defer func() {
-		if cerr := f.Close(); cerr != nil && err == nil {
-			err = cerr
+	var files []string
+	info, err := os.Stat(c.target)
+	if err == nil && info.IsDir() {
+		files, err = crkr.FindVineMetadata(c.target)
+	} else if err == nil {
+		files, err = crkr.PlaylistMetadataFiles(c.target)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nerrors, nmigrated := 0, 0
+	for _, file := range files {
+		if ctx.Err() != nil {
+			break
 		}
-	}()
-	if err := crkr.WriteM3U(f, vines); err != nil {
+		migrated, err := crkr.MigrateVineMetadata(file, c.strict)
+		if err != nil {
+			nerrors++
+			log.Printf("migrate %s: %s", file, err)
+		} else if migrated {
+			nmigrated++
+			if crkr.Verbose {
+				log.Printf("migrated %s", file)
+			}
+		}
+	}
+	exitIfInterrupted(ctx, "migrated %d metadata files", nmigrated)
+	log.Printf("migrated %d/%d metadata files to version %d", nmigrated, len(files), crkr.MetadataVersion)
+	if nerrors > 0 {
+		log.Fatalf("%d/%d failed", nerrors, len(files))
+	}
+}
+
+func (c *MigrateCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
+	if err != nil {
 		return err
 	}
+	if flags.NArg() != 1 {
+		return nargsErr
+	}
+	c.target = flags.Arg(0)
 	return nil
 }
 
+// probeVideos reports whether videos should be checked with ffprobe, which is
+// done unless noprobe is set or ffprobe isn't installed.
+func probeVideos(noprobe bool) bool {
+	if noprobe {
+		return false
+	}
+	if !crkr.FFprobeAvailable() {
+		log.Print("ffprobe not found, so videos won't be probed")
+		return false
+	}
+	return true
+}
+
 type SubtitlesCmd struct {
 	flagSet    *flag.FlagSet
 	plainEmoji bool
@@ -152,7 +1597,7 @@ func (c *SubtitlesCmd) PrintUsage(w io.Writer) {
 	printCmdUsage(w, usage, c.flags())
 }
 
-func (c *SubtitlesCmd) Run(args []string) {
+func (c *SubtitlesCmd) Run(ctx context.Context, args []string) {
 	err := c.parseArgs(args)
 	if err != nil {
 		fatalCmdUsage(c, err)
@@ -189,6 +1634,10 @@ func (c *SubtitlesCmd) parseArgs(args []string) error {
 
 type HardSubCmd struct {
 	flagSet       *flag.FlagSet
+	jobs          jobsFlags
+	progress      progressFlags
+	report        reportFlags
+	catalog       catalogFlags
 	font          string
 	fontSize      int
 	force         bool
@@ -204,6 +1653,10 @@ func (c *HardSubCmd) flags() *flag.FlagSet {
 	c.flagSet.IntVar(&c.fontSize, "fontsize", 12, "font `size`")
 	c.flagSet.StringVar(&c.font, "font", "Arial", "font `name`")
 	c.flagSet.BoolVar(&c.force, "force", false, "overwrite subtitled videos")
+	c.jobs.register(c.flagSet, true)
+	c.progress.register(c.flagSet)
+	c.report.register(c.flagSet, false)
+	c.catalog.register(c.flagSet)
 	return c.flagSet
 }
 
@@ -213,24 +1666,25 @@ func (c *HardSubCmd) PrintUsage(w io.Writer) {
 	printCmdUsage(w, usage, c.flags())
 }
 
-func (c *HardSubCmd) Run(args []string) {
+func (c *HardSubCmd) Run(ctx context.Context, args []string) {
 	err := c.parseArgs(args)
 	if err != nil {
 		fatalCmdUsage(c, err)
 	}
+	c.jobs.apply()
+	c.progress.apply()
+	c.report.start("hardsub", args, c.m3uOut+".failures.json")
 
-	inFile, err := os.Open(c.m3uIn)
+	files, err := crkr.ReadM3UFile(c.m3uIn)
 	if err != nil {
-		log.Fatalf("open playlist: %s", err)
-	}
-	defer inFile.Close()
-	files, err := crkr.ReadM3U(inFile)
-	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("read playlist: %s", err)
 	}
 
-	err = crkr.ScaleAll(files)
+	err = crkr.ScaleAllContext(ctx, files)
+	exitIfInterrupted(ctx, "scaling incomplete, no subtitles rendered")
 	if err != nil {
+		c.report.fail("scale", c.m3uIn, err)
+		c.report.finish(1)
 		log.Fatalf("scale: %s", err)
 	}
 
@@ -246,28 +1700,24 @@ func (c *HardSubCmd) Run(args []string) {
 		}
 	}
 
-	err = crkr.RenderAllSubtitles(render, c.font, c.fontSize)
+	err = crkr.RenderAllSubtitlesContext(ctx, render, c.font, c.fontSize)
 	if err != nil {
 		log.Println(err)
 	}
-
-	outFile, err := os.Create(c.m3uOut)
-	if err != nil {
-		log.Fatalf("write playlist: %s", err)
-	}
-	defer func() {
-		if err := outFile.Close(); err != nil {
-			log.Printf("write playlist: %s", err)
-		}
-	}()
-	_, err = inFile.Seek(0, os.SEEK_SET)
-	if err != nil {
-		log.Fatal(err)
+	rendered := make([]string, len(render))
+	for i, f := range render {
+		rendered[i] = crkr.SubtitledVideoFilename(f)
 	}
-	err = crkr.HardSubM3U(outFile, inFile)
+	c.catalog.refresh(files)
+	exitIfInterrupted(ctx, "rendered subtitles for %d/%d videos", countExisting(rendered), len(render))
+
+	err = crkr.HardSubM3UFile(c.m3uOut, c.m3uIn)
 	if err != nil {
+		c.report.fail("playlist", c.m3uOut, err)
+		c.report.finish(1)
 		log.Fatalf("write playlist: %s", err)
 	}
+	c.report.finish(0)
 }
 
 func (c *HardSubCmd) parseArgs(args []string) error {
@@ -286,6 +1736,8 @@ func (c *HardSubCmd) parseArgs(args []string) error {
 
 type ConcatCmd struct {
 	flagSet  *flag.FlagSet
+	jobs     jobsFlags
+	progress progressFlags
 	playlist string
 	video    string
 }
@@ -296,36 +1748,37 @@ func (c *ConcatCmd) flags() *flag.FlagSet {
 	}
 	c.flagSet = flag.NewFlagSet("concat", flag.ContinueOnError)
 	c.flagSet.SetOutput(ioutil.Discard)
+	c.jobs.register(c.flagSet, true)
+	c.progress.register(c.flagSet)
 	return c.flagSet
 }
 
 func (c *ConcatCmd) PrintUsage(w io.Writer) {
-	usage := `concat <m3u> <video>
+	usage := `concat [<opts>] <m3u> <video>
   Losslessly concatenate a playlist of MP4 videos into one video.`
 	printCmdUsage(w, usage, c.flags())
 
 }
 
-func (c *ConcatCmd) Run(args []string) {
+func (c *ConcatCmd) Run(ctx context.Context, args []string) {
 	err := c.parseArgs(args)
 	if err != nil {
 		fatalCmdUsage(c, err)
 	}
+	c.jobs.apply()
+	c.progress.apply()
 
-	plFile, err := os.Open(c.playlist)
-	if err != nil {
-		log.Fatalf("open playlist: %s", err)
-	}
-	defer plFile.Close()
-	files, err := crkr.ReadM3U(plFile)
+	files, err := crkr.ReadM3UFile(c.playlist)
 	if err != nil {
 		log.Fatalf("read playlist: %s", err)
 	}
-	err = crkr.ScaleAll(files)
+	err = crkr.ScaleAllContext(ctx, files)
+	exitIfInterrupted(ctx, "scaling incomplete, nothing concatenated")
 	if err != nil {
 		log.Fatalf("scale: %s", err)
 	}
-	err = crkr.ConcatVideos(files, c.video)
+	err = crkr.ConcatVideosContext(ctx, files, c.video)
+	exitIfInterrupted(ctx, "concatenation incomplete, %s removed", c.video)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -345,6 +1798,133 @@ func (c *ConcatCmd) parseArgs(args []string) error {
 	return nil
 }
 
+// exitIfInterrupted reports what was completed and exits if ctx was cancelled
+// by a signal. Deferred functions aren't run, so callers must clean up first.
+// onExit, if not nil, is called by exitIfInterrupted before exiting.
+var onExit func()
+
+func exitIfInterrupted(ctx context.Context, format string, args ...interface{}) {
+	if ctx.Err() == nil {
+		return
+	}
+	log.Printf("interrupted: "+format, args...)
+	if onExit != nil {
+		onExit()
+	}
+	os.Exit(130)
+}
+
+func videoFilenames(vines []crkr.Vine) []string {
+	files := make([]string, len(vines))
+	for i, v := range vines {
+		files[i] = v.VideoFilename()
+	}
+	return files
+}
+
+func countExisting(files []string) int {
+	n := 0
+	for _, f := range files {
+		if crkr.FileExists(f) {
+			n++
+		}
+	}
+	return n
+}
+
+type RetryCmd struct {
+	flagSet *flag.FlagSet
+	report  string
+}
+
+func (c *RetryCmd) PrintUsage(w io.Writer) {
+	usage := `retry <report>
+  Retry the items that failed in a run of get, sync, import-archive or
+  hardsub, as listed in the failure report it wrote. get only retries the
+  failed items and adds them to its playlist; the other commands are run
+  again with the same arguments, and skip what was already done.`
+	printCmdUsage(w, usage, c.flags())
+}
+
+func (c *RetryCmd) flags() *flag.FlagSet {
+	if c.flagSet != nil {
+		return c.flagSet
+	}
+	c.flagSet = flag.NewFlagSet("retry", flag.ContinueOnError)
+	c.flagSet.SetOutput(ioutil.Discard)
+	return c.flagSet
+}
+
+func (c *RetryCmd) parseArgs(args []string) error {
+	flags := c.flags()
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return nargsErr
+	}
+	c.report = flags.Arg(0)
+	return nil
+}
+
+func (c *RetryCmd) Run(ctx context.Context, args []string) {
+	err := c.parseArgs(args)
+	if err != nil {
+		fatalCmdUsage(c, err)
+	}
+	prev, err := crkr.ReadFailureReport(c.report)
+	if err != nil {
+		log.Fatalf("read failure report: %s", err)
+	}
+	if len(prev.Failures) == 0 {
+		log.Print("nothing to retry")
+		return
+	}
+	// Relative paths in the arguments are relative to where the command was
+	// run.
+	err = os.Chdir(prev.Dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	args = withoutForce(prev.Args)
+	switch prev.Command {
+	case "get":
+		cmd := &GetCmd{}
+		cmd.retry(ctx, prev, args)
+	case "sync":
+		cmd := &SyncCmd{}
+		cmd.report.prev = prev
+		cmd.Run(ctx, args)
+	case "import-archive":
+		cmd := &ImportArchiveCmd{}
+		cmd.report.prev = prev
+		cmd.Run(ctx, args)
+	case "hardsub":
+		cmd := &HardSubCmd{}
+		cmd.report.prev = prev
+		cmd.Run(ctx, args)
+	default:
+		log.Fatalf("%s: can't retry command %q", c.report, prev.Command)
+	}
+}
+
+// withoutForce returns args without the -force option, so retried commands
+// don't redo the work that succeeded.
+func withoutForce(args []string) []string {
+	kept := []string{}
+	for _, arg := range args {
+		switch strings.TrimLeft(arg, "-") {
+		case "force", "force=true", "force=1":
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+		}
+		kept = append(kept, arg)
+	}
+	return kept
+}
+
 func printCmdUsage(w io.Writer, cmdUsage string, flags *flag.FlagSet) {
 	fmt.Fprintln(w, cmdUsage)
 	flags.SetOutput(w)
@@ -354,11 +1934,11 @@ func printCmdUsage(w io.Writer, cmdUsage string, flags *flag.FlagSet) {
 func printUsage(w io.Writer, globalFlags *flag.FlagSet, commands map[string]Cmd) {
 	fmt.Fprintf(w, "crkr version %s\n", version)
 	fmt.Fprintln(w, "usage: crkr <global_opts> <command> <opts> <args>")
-	fmt.Fprintln(w, "\nglobal options:\n")
+	fmt.Fprint(w, "\nglobal options:\n\n")
 	globalFlags.SetOutput(w)
 	globalFlags.PrintDefaults()
-	fmt.Fprintln(w, "\ncommands:\n")
-	for _, name := range []string{"get", "subtitles", "hardsub", "concat"} {
+	fmt.Fprint(w, "\ncommands:\n\n")
+	for _, name := range []string{"get", "sync", "import-archive", "subtitles", "hardsub", "retry", "concat", "verify", "query", "migrate", "cache"} {
 		commands[name].PrintUsage(w)
 	}
 }
@@ -375,10 +1955,17 @@ func main() {
 	log.SetFlags(log.Ltime)
 
 	commands := map[string]Cmd{
-		"get":       &GetCmd{},
-		"subtitles": &SubtitlesCmd{},
-		"hardsub":   &HardSubCmd{},
-		"concat":    &ConcatCmd{},
+		"get":            &GetCmd{},
+		"sync":           &SyncCmd{},
+		"import-archive": &ImportArchiveCmd{},
+		"subtitles":      &SubtitlesCmd{},
+		"hardsub":        &HardSubCmd{},
+		"retry":          &RetryCmd{},
+		"concat":         &ConcatCmd{},
+		"verify":         &VerifyCmd{},
+		"query":          &QueryCmd{},
+		"migrate":        &MigrateCmd{},
+		"cache":          &CacheCmd{},
 	}
 
 	globalFlags := flag.NewFlagSet("crkr", flag.ContinueOnError)
@@ -417,5 +2004,14 @@ func main() {
 		printUsage(os.Stderr, globalFlags, commands)
 		os.Exit(2)
 	}
-	cmd.Run(cmdArgs)
+
+	// Cancel in-flight work on the first interrupt, and restore the default
+	// behaviour so a second one kills crkr immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	cmd.Run(ctx, cmdArgs)
+	stop()
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	crkr "github.com/torbiak/creeperkeeper"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressFlags are options for commands that report progress.
+type progressFlags struct {
+	mode string
+}
+
+func (p *progressFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.mode, "progress", "auto", "show progress as a `bar` on stderr, as json events on stdout, or none. auto shows a bar if stderr is a terminal")
+}
+
+// apply configures the crkr package to report progress according to the
+// flags.
+func (p *progressFlags) apply() {
+	mode := p.mode
+	if mode == "auto" {
+		mode = "none"
+		if isTerminal(os.Stderr) {
+			mode = "bar"
+		}
+	}
+	switch mode {
+	case "none":
+		crkr.Progress = nil
+	case "bar":
+		bar := newProgressBar(os.Stderr)
+		// Log messages are printed above the bar.
+		log.SetOutput(bar)
+		crkr.Progress = bar.report
+	case "json":
+		j := &jsonProgress{enc: json.NewEncoder(os.Stdout)}
+		crkr.Progress = j.report
+	default:
+		log.Fatalf("-progress: want auto, bar, json, or none, got %q", p.mode)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// jsonProgress writes events as newline-delimited JSON.
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (j *jsonProgress) report(e crkr.Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(e)
+}
+
+// progressBar draws a line for the current stage showing how many of its jobs
+// are done and an estimate of the time remaining. When a stage finishes its
+// line is left as a summary.
+//
+// Stages can be nested, as when fetching the metadata for each of a list of
+// users, and the same stage can be started several times at once, in which
+// case the counts are combined. The most recently started stage is shown.
+type progressBar struct {
+	mu    sync.Mutex
+	w     io.Writer
+	width int
+
+	stages map[string]*stageProgress
+	// order holds the names of unfinished stages, most recent last.
+	order    []string
+	drawn    bool
+	lastDraw time.Time
+}
+
+type stageProgress struct {
+	name    string
+	active  int // Times started but not yet finished.
+	total   int
+	done    int
+	failed  int
+	started time.Time
+	// running holds the fraction completed of each running job.
+	running map[string]float64
+	// bytes holds how much has been downloaded from each URL.
+	bytes map[string]int64
+}
+
+// barRedrawInterval limits how often the bar is redrawn.
+const barRedrawInterval = 100 * time.Millisecond
+
+func newProgressBar(w io.Writer) *progressBar {
+	width := 80
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		width = n
+	}
+	return &progressBar{w: w, width: width, stages: map[string]*stageProgress{}}
+}
+
+func (b *progressBar) report(e crkr.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e.Kind == crkr.StageStarted {
+		b.startStage(e)
+		b.draw()
+		return
+	}
+	st := b.stages[e.Stage]
+	if st == nil {
+		return
+	}
+	switch e.Kind {
+	case crkr.StageFinished:
+		b.finishStage(st, e.Time)
+		b.draw()
+		return
+	case crkr.JobStarted:
+		st.running[e.Job] = 0
+	case crkr.JobFinished:
+		delete(st.running, e.Job)
+		st.done++
+	case crkr.JobFailed:
+		delete(st.running, e.Job)
+		st.done++
+		st.failed++
+	case crkr.Transfer:
+		if e.URL != "" {
+			st.bytes[e.URL] = e.Bytes
+		}
+		if _, ok := st.running[e.Job]; ok && e.Size > 0 {
+			st.running[e.Job] = float64(e.Bytes) / float64(e.Size)
+		}
+		if time.Since(b.lastDraw) < barRedrawInterval {
+			return
+		}
+	case crkr.Encode:
+		if _, ok := st.running[e.Job]; ok {
+			st.running[e.Job] = e.Percent / 100
+		}
+		if time.Since(b.lastDraw) < barRedrawInterval {
+			return
+		}
+	}
+	b.draw()
+}
+
+func (b *progressBar) startStage(e crkr.Event) {
+	st := b.stages[e.Stage]
+	if st == nil {
+		st = &stageProgress{
+			name:    e.Stage,
+			started: e.Time,
+			running: map[string]float64{},
+			bytes:   map[string]int64{},
+		}
+		b.stages[e.Stage] = st
+	} else {
+		b.removeFromOrder(e.Stage)
+	}
+	b.order = append(b.order, e.Stage)
+	st.active++
+	st.total += e.Total
+}
+
+// finishStage prints a summary once every start of a stage has finished.
+func (b *progressBar) finishStage(st *stageProgress, now time.Time) {
+	st.active--
+	if st.active > 0 {
+		return
+	}
+	delete(b.stages, st.name)
+	b.removeFromOrder(st.name)
+	if st.total == 0 {
+		return
+	}
+	b.clear()
+	fmt.Fprintln(b.w, st.summary(now))
+}
+
+func (b *progressBar) removeFromOrder(name string) {
+	for i, s := range b.order {
+		if s == name {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// Write prints log messages above the bar.
+func (b *progressBar) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+	n, err := b.w.Write(p)
+	b.draw()
+	return n, err
+}
+
+func (b *progressBar) clear() {
+	if b.drawn {
+		fmt.Fprint(b.w, "\r\x1b[K")
+		b.drawn = false
+	}
+}
+
+// draw redraws the bar for the most recently started stage, if any.
+func (b *progressBar) draw() {
+	b.clear()
+	if len(b.order) == 0 {
+		return
+	}
+	st := b.stages[b.order[len(b.order)-1]]
+	if st.total == 0 {
+		return
+	}
+	frac := float64(st.done)
+	for _, f := range st.running {
+		frac += f
+	}
+	frac /= float64(st.total)
+	elapsed := time.Since(st.started)
+
+	var extra []string
+	if n := st.totalBytes(); n > 0 {
+		extra = append(extra, formatBytes(n))
+		if elapsed >= time.Second {
+			extra = append(extra, formatBytes(int64(float64(n)/elapsed.Seconds()))+"/s")
+		}
+	}
+	if st.failed > 0 {
+		extra = append(extra, fmt.Sprintf("%d failed", st.failed))
+	}
+	if frac > 0 && elapsed >= time.Second {
+		eta := time.Duration(float64(elapsed) * (1 - frac) / frac)
+		extra = append(extra, "ETA "+formatDuration(eta))
+	}
+
+	prefix := fmt.Sprintf("%s %d/%d ", st.name, st.done, st.total)
+	suffix := " " + strings.Join(extra, "  ")
+	barWidth := b.width - len(prefix) - len(suffix) - 3
+	if barWidth > 40 {
+		barWidth = 40
+	}
+	line := prefix
+	if barWidth >= 10 {
+		filled := int(frac * float64(barWidth))
+		line += "[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "]"
+	}
+	line += suffix
+	if len(line) > b.width-1 {
+		line = line[:b.width-1]
+	}
+	fmt.Fprint(b.w, line)
+	b.drawn = true
+	b.lastDraw = time.Now()
+}
+
+func (st *stageProgress) summary(now time.Time) string {
+	s := fmt.Sprintf("%s: %d/%d done", st.name, st.done-st.failed, st.total)
+	if st.failed > 0 {
+		s += fmt.Sprintf(", %d failed", st.failed)
+	}
+	if n := st.totalBytes(); n > 0 {
+		s += ", " + formatBytes(n)
+	}
+	return s + " in " + formatDuration(now.Sub(st.started))
+}
+
+func (st *stageProgress) totalBytes() int64 {
+	var n int64
+	for _, v := range st.bytes {
+		n += v
+	}
+	return n
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -4,6 +4,7 @@ package creeperkeeper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
@@ -17,7 +18,12 @@ func runCmd(cmd *exec.Cmd) (stdout []byte, err error) {
 	}
 	stderr := &bytes.Buffer{}
 	cmd.Stderr = stderr
-	stdout, err = cmd.Output()
+	if cmd.Stdout != nil {
+		// The caller is handling stdout itself.
+		err = cmd.Run()
+	} else {
+		stdout, err = cmd.Output()
+	}
 	if err == nil && len(stderr.String()) > 0 {
 		log.Print("exit status 0: ", cmdLine, "\nstderr:\n", stderr.String())
 	}
@@ -26,3 +32,17 @@ func runCmd(cmd *exec.Cmd) (stdout []byte, err error) {
 	}
 	return stdout, nil
 }
+
+// runFFmpeg runs an ffmpeg command that reads input, reporting how far
+// through input it is as Encode events if Progress is set.
+func runFFmpeg(ctx context.Context, cmd *exec.Cmd, input string) error {
+	if Progress != nil {
+		if d, err := videoDuration(ctx, input); err == nil {
+			args := []string{cmd.Args[0], "-progress", "pipe:1", "-nostats"}
+			cmd.Args = append(args, cmd.Args[1:]...)
+			cmd.Stdout = &ffmpegProgress{ctx: ctx, duration: d}
+		}
+	}
+	_, err := runCmd(cmd)
+	return err
+}
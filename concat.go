@@ -1,6 +1,7 @@
 package creeperkeeper
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,18 +16,25 @@ import (
 // for f in *.ts; do printf "file '%s'\n" $f; done >files
 // ffmpeg -f concat -i files -c copy output.mp4
 func ConcatVideos(videoFiles []string, outFile string) error {
+	return ConcatVideosContext(context.Background(), videoFiles, outFile)
+}
+
+// ConcatVideosContext is like ConcatVideos but kills ffmpeg and removes the
+// partial output file when ctx is done.
+func ConcatVideosContext(ctx context.Context, videoFiles []string, outFile string) error {
 	dir, err := ioutil.TempDir("", "crkr")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(dir)
 
+	// Videos in different directories can have the same name, so the
+	// intermediate files are numbered.
 	tsFiles := []string{}
-	for _, f := range videoFiles {
-		base := filepath.Base(f)
-		tsFile := filepath.Join(dir, strings.TrimSuffix(base, ".mp4")+".ts")
+	for i, f := range videoFiles {
+		tsFile := filepath.Join(dir, fmt.Sprintf("%d.ts", i))
 		tsFiles = append(tsFiles, tsFile)
-		err := mp4ToTransportStream(f, tsFile)
+		err := mp4ToTransportStream(ctx, f, tsFile)
 		if err != nil {
 			return err
 		}
@@ -38,7 +46,7 @@ func ConcatVideos(videoFiles []string, outFile string) error {
 	}
 	defer os.Remove(tmpFile.Name())
 	for _, f := range tsFiles {
-		_, err := fmt.Fprintf(tmpFile, "file '%s'\n", f)
+		_, err := fmt.Fprintf(tmpFile, "file %s\n", concatQuote(f))
 		if err != nil {
 			tmpFile.Close()
 			return err
@@ -49,7 +57,8 @@ func ConcatVideos(videoFiles []string, outFile string) error {
 		return err
 	}
 
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"ffmpeg",
 		"-y",
 		"-v", "warning",
@@ -61,11 +70,22 @@ func ConcatVideos(videoFiles []string, outFile string) error {
 		"-c", "copy",
 		outFile)
 	_, err = runCmd(cmd)
+	if err != nil {
+		os.Remove(outFile)
+	}
 	return err
 }
 
-func mp4ToTransportStream(inFile, outFile string) error {
-	cmd := exec.Command(
+// concatQuote quotes a filename for an ffmpeg concat list. Single quotes
+// can't be escaped inside quotes, so each one ends the quoted string, is
+// escaped with a backslash, and starts a new one.
+func concatQuote(name string) string {
+	return "'" + strings.Replace(name, "'", `'\''`, -1) + "'"
+}
+
+func mp4ToTransportStream(ctx context.Context, inFile, outFile string) error {
+	cmd := exec.CommandContext(
+		ctx,
 		"ffmpeg",
 		"-y", // Support multiple instances of the same video in a playlist.
 		"-v", "warning",
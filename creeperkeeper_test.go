@@ -2,81 +2,1513 @@ package creeperkeeper
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"text/template"
 	"time"
+
+	"github.com/torbiak/creeperkeeper/crkrtest"
 )
 
-var subTemplate = template.Must(template.New("subtitles").Parse("{{.Title}}"))
+var subTemplate = template.Must(template.New("subtitles").Parse("{{.Title}}"))
+
+// useFakeArchive points the package at a fake archive for the duration of a
+// test.
+func useFakeArchive(t *testing.T) *crkrtest.Archive {
+	archive := crkrtest.NewArchive()
+	origArchiveURL, origClient := ArchiveURL, Client
+	ArchiveURL, Client = archive.URL, archive.Client()
+	t.Cleanup(func() {
+		ArchiveURL, Client = origArchiveURL, origClient
+		archive.Close()
+	})
+	return archive
+}
+
+// chdirTemp changes to a new temporary directory for the duration of a test.
+func chdirTemp(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "crkr_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(origDir)
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestExtractVines_singleVine(t *testing.T) {
+	archive := useFakeArchive(t)
+	got, err := ExtractVines("https://vine.co/v/b9KOOWX7HUx")
+	if err != nil {
+		t.Error(err)
+	}
+	want := []Vine{
+		{
+			Title:        "Chicken.",
+			Uploader:     "Jack",
+			UploaderID:   "76",
+			URL:          archive.VideoURL("b9KOOWX7HUx"),
+			UUID:         "b9KOOWX7HUx",
+			Created:      time.Date(2013, 5, 19, 21, 12, 31, 0, time.UTC),
+			Loops:        1234567,
+			Likes:        8910,
+			Reposts:      1112,
+			Comments:     131,
+			Venue:        "Twitter HQ",
+			Permalink:    "https://vine.co/v/b9KOOWX7HUx",
+			ThumbnailURL: archive.ThumbnailURL("b9KOOWX7HUx"),
+			AvatarURL:    archive.AvatarURL("76"),
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExtractVines_entities(t *testing.T) {
+	useFakeArchive(t)
+	got, err := ExtractVines("https://vine.co/v/Mz2Wzi73VnI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d vines, want 1", len(got))
+	}
+	vine := got[0]
+	wantTags := []string{"superbowl", "sexism", "relatable"}
+	if !reflect.DeepEqual(vine.Hashtags, wantTags) {
+		t.Errorf("got hashtags %q, want %q", vine.Hashtags, wantTags)
+	}
+	wantMentions := []Mention{{UserID: "56", Username: "dom"}}
+	if !reflect.DeepEqual(vine.Mentions, wantMentions) {
+		t.Errorf("got mentions %v, want %v", vine.Mentions, wantMentions)
+	}
+	if !vine.Explicit {
+		t.Error("want explicit")
+	}
+}
+
+func TestExtractVines_userPosts(t *testing.T) {
+	useFakeArchive(t)
+	vines, err := ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLen := 5
+	if len(vines) != wantLen {
+		t.Errorf("got %d, want %d", len(vines), wantLen)
+	}
+	wantTitles := []string{"le rain.", "spill", "UCB", "ballgame", "kinect"}
+	var missing []string
+	for _, title := range wantTitles {
+		found := false
+		for _, vine := range vines {
+			if vine.Title == title {
+				found = true
+			}
+		}
+		if !found {
+			missing = append(missing, title)
+		}
+	}
+	if len(missing) > 0 {
+		t.Errorf("missing titles: %s", strings.Join(missing, ", "))
+	}
+}
+
+func TestExtractVines_vanity(t *testing.T) {
+	useFakeArchive(t)
+	vines, err := ExtractVines("https://vine.co/jack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vines) != 1 || vines[0].UUID != "b9KOOWX7HUx" {
+		t.Errorf("got %v, want b9KOOWX7HUx", vines)
+	}
+}
+
+func TestParseVineURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want VineURL
+	}{
+		{"b9KOOWX7HUx", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://vine.co/v/b9KOOWX7HUx", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://vine.co/v/b9KOOWX7HUx/embed/simple", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://vine.co/v/b9KOOWX7HUx/card", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"http://vine.co/oembed/b9KOOWX7HUx", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"www.vine.co/v/b9KOOWX7HUx", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://vine.co/v/b9KOOWX7HUx?autoplay=1#top", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{" (https://vine.co/v/b9KOOWX7HUx).", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"<https://vine.co/v/b9KOOWX7HUx>", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://archive.vine.co/posts/b9KOOWX7HUx.json", VineURL{PostURL, "b9KOOWX7HUx"}},
+		{"https://vine.co/u/76", VineURL{UserURL, "76"}},
+		{"vine.co/u/76/", VineURL{UserURL, "76"}},
+		{"https://archive.vine.co/profiles/76.json", VineURL{UserURL, "76"}},
+		{"https://vine.co/jack", VineURL{VanityURL, "jack"}},
+		{"https://vine.co/Jack?mode=grid", VineURL{VanityURL, "Jack"}},
+		{"https://archive.vine.co/vanities/jack.json", VineURL{VanityURL, "jack"}},
+		{"https://vine.co/u/76/likes", VineURL{LikesURL, "76"}},
+		{"https://vine.co/jack/likes", VineURL{LikesURL, "jack"}},
+	}
+	for _, test := range tests {
+		got, err := ParseVineURL(test.url)
+		if err != nil {
+			t.Errorf("%q: %s", test.url, err)
+		} else if got != test.want {
+			t.Errorf("%q: got %v, want %v", test.url, got, test.want)
+		}
+	}
+
+	for _, url := range []string{
+		"",
+		"https://example.com/v/b9KOOWX7HUx",
+		"https://vine.co/",
+		"https://vine.co/tags/cats",
+		"https://vine.co/u/abc",
+		"https://vine.co/u/76/followers",
+		"https://archive.vine.co/posts/b9KOOWX7HUx",
+		"12345678901",
+	} {
+		if got, err := ParseVineURL(url); err == nil {
+			t.Errorf("%q: got %v, want error", url, got)
+		}
+	}
+}
+
+func TestExtractVines_likes(t *testing.T) {
+	useFakeArchive(t)
+	_, err := ExtractVines("https://vine.co/u/76/likes")
+	if err == nil || !strings.Contains(err.Error(), "archived") {
+		t.Errorf("got %v, want an error saying likes weren't archived", err)
+	}
+}
+
+func TestResolveVanity(t *testing.T) {
+	archive := useFakeArchive(t)
+	dir := chdirTemp(t)
+	origVanities, origLearned := Vanities, LearnedVanities
+	defer func() { Vanities, LearnedVanities = origVanities, origLearned }()
+	ctx := context.Background()
+
+	// Only the archive knows jack, only the mapping file knows dom, and the
+	// posts know mielmonster.
+	delete(archive.Vanities, "dom")
+	writeFile(t, "vanities.txt", "# name id\nDom 56\n")
+	m, err := ReadVanityFile("vanities.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	learned, err := OpenVanityCache(filepath.Join(dir, "cache", "vanities.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Vanities, LearnedVanities = []VanityResolver{ArchiveVanities{}, m}, learned
+	_, err = ExtractVines("https://vine.co/v/Mz2Wzi73VnI")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{"jack": "76", "dom": "56", "MielMonster": "973499529959968768"} {
+		got, err := resolveVanity(ctx, name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if got != want {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+
+	// Learned names are remembered between runs.
+	learned, err = OpenVanityCache(learned.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := learned.Resolve(ctx, "mielmonster"); err != nil || id != "973499529959968768" {
+		t.Errorf("reloaded learned vanities: got %q, %v", id, err)
+	}
+
+	_, err = resolveVanity(ctx, "torbiak")
+	if err == nil {
+		t.Fatal("error expected for unknown name")
+	}
+	for _, name := range []string{"archive", "vanities.txt", "learned"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error doesn't name resolver %s: %s", name, err)
+		}
+	}
+}
+
+func TestExtractVines_apiError(t *testing.T) {
+	useFakeArchive(t)
+	_, err := ExtractVines("https://vine.co/api/users/profiles/vanity/torbiak")
+	if err == nil {
+		t.Error("error expected for nonexistant vanity url")
+	}
+	_, err = ExtractVines("https://vine.co/torbiak")
+	if err == nil {
+		t.Error("error expected for unknown vanity name")
+	}
+}
+
+func TestExtractAllVines(t *testing.T) {
+	useFakeArchive(t)
+	list := `# dom and one of his vines
+https://vine.co/u/56
+
+  https://vine.co/v/hEDd9ZVPIrj
+https://vine.co/v/nonexistent
+`
+	urls, err := ReadURLList(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 3 || urls[1] != "https://vine.co/v/hEDd9ZVPIrj" {
+		t.Fatalf("got urls %q", urls)
+	}
+	sources, err := ExtractAllVines(context.Background(), urls)
+	if err == nil {
+		t.Error("error expected for nonexistent vine")
+	}
+	if len(sources) != 3 || len(sources[0]) != 5 || len(sources[1]) != 1 || len(sources[2]) != 0 {
+		t.Fatalf("got sources %v", sources)
+	}
+	var all []Vine
+	for _, src := range sources {
+		all = append(all, src...)
+	}
+	if n := len(DedupeVines(all)); n != 5 {
+		t.Errorf("got %d unique vines, want 5", n)
+	}
+}
+
+// countingTransport counts requests and records the most that were in flight
+// at once.
+type countingTransport struct {
+	base http.RoundTripper
+
+	mu                      sync.Mutex
+	requests, inFlight, max int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests++
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mu.Unlock()
+	// Give other requests a chance to overlap.
+	time.Sleep(5 * time.Millisecond)
+	resp, err := c.base.RoundTrip(req)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return resp, err
+}
+
+func TestExtractAllVines_sharedLimit(t *testing.T) {
+	archive := useFakeArchive(t)
+	transport := &countingTransport{base: archive.Client().Transport}
+	Client = &http.Client{Transport: transport}
+	origJobs := Jobs
+	Jobs.Metadata = 2
+	t.Cleanup(func() { Jobs = origJobs })
+
+	urls := []string{"https://vine.co/u/56", "https://vine.co/u/56", "https://vine.co/u/56", "https://vine.co/v/hEDd9ZVPIrj"}
+	_, err := ExtractAllVines(context.Background(), urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport.max > 2 {
+		t.Errorf("%d requests in flight at once, want at most 2", transport.max)
+	}
+}
+
+func TestGetPipeline(t *testing.T) {
+	useFakeArchive(t)
+	chdirTemp(t)
+	vines, err := ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteAllVineMetadata(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadVines(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vine := range vines {
+		b, err := ioutil.ReadFile(vine.VideoFilename())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(b, crkrtest.TinyMP4) {
+			t.Errorf("%s: unexpected contents %q", vine.VideoFilename(), b)
+		}
+		if !FileExists(vine.MetadataFilename()) {
+			t.Errorf("%s: missing metadata", vine.UUID)
+		}
+	}
+}
+
+func TestDownloadVinesOptions_images(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	vines, err := ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := DownloadOptions{Thumbnails: true, Avatars: true}
+	err = DownloadVinesOptions(vines, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, vine := range vines {
+		if vine.ThumbnailFile != vine.UUID+".jpg" {
+			t.Errorf("got thumbnail file %q, want %s.jpg", vine.ThumbnailFile, vine.UUID)
+		}
+		if vine.AvatarFile != "56.avatar.jpg" {
+			t.Errorf("got avatar file %q, want 56.avatar.jpg", vine.AvatarFile)
+		}
+		for _, file := range []string{vine.VideoFilename(), vine.ThumbnailFile} {
+			if !FileExists(file) {
+				t.Errorf("%s missing", file)
+			}
+		}
+	}
+	if n := archive.Requests("/avatars/56.jpg"); n != 1 {
+		t.Errorf("avatar requested %d times, want 1", n)
+	}
+
+	// Existing files are skipped unless forced.
+	err = DownloadVinesOptions(vines, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := archive.Requests("/videos/" + vines[0].UUID + ".mp4"); n != 1 {
+		t.Errorf("video requested %d times, want 1", n)
+	}
+}
+
+func TestDownloadVinesContext_cancel(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	origRetry := Retry
+	Retry = RetryPolicy{MaxAttempts: 5, MinBackoff: time.Hour, MaxBackoff: time.Hour}
+	defer func() { Retry = origRetry }()
+
+	// The request fails and would be retried in an hour, but the context is
+	// cancelled first.
+	vine := Vine{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")}
+	archive.Fail("/videos/b9KOOWX7HUx.mp4", 1, http.StatusServiceUnavailable, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := DownloadVinesContext(ctx, []Vine{vine}, DownloadOptions{})
+	if err == nil {
+		t.Fatal("error expected for cancelled download")
+	}
+	if FileExists(vine.VideoFilename()) {
+		t.Error("partial download not removed")
+	}
+
+	// Jobs aren't started after cancellation.
+	err = DownloadVinesContext(ctx, []Vine{vine}, DownloadOptions{})
+	if err == nil {
+		t.Fatal("error expected for cancelled download")
+	}
+	if n := archive.Requests("/videos/b9KOOWX7HUx.mp4"); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestParallel(t *testing.T) {
+	ctx := context.Background()
+	jobs := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, atOnce := range []int{0, 1, 3} {
+		var mu sync.Mutex
+		running, max := 0, 0
+		f := func(ctx context.Context, n int) (int, error) {
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			// Finish out of order.
+			time.Sleep(time.Duration(10-n) * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if n%4 == 0 {
+				return 0, fmt.Errorf("%d", n)
+			}
+			return n * n, nil
+		}
+		results := parallel(ctx, jobs, poolOptions{atOnce: atOnce}, f)
+		want := atOnce
+		if want < 1 {
+			want = 1
+		}
+		if max != want {
+			t.Errorf("atOnce=%d: got %d jobs at once", atOnce, max)
+		}
+		for i, r := range results {
+			n := jobs[i]
+			if n%4 == 0 && (r.err == nil || r.err.Error() != fmt.Sprint(n)) {
+				t.Errorf("atOnce=%d: job %d: got error %v", atOnce, n, r.err)
+			} else if n%4 != 0 && (r.err != nil || r.val != n*n) {
+				t.Errorf("atOnce=%d: job %d: got %d, %v, want %d", atOnce, n, r.val, r.err, n*n)
+			}
+		}
+		err := batchError(ctx, "square", results)
+		be, ok := err.(*BatchError)
+		if !ok || len(be.Errs) != 2 || be.Errs[3] == nil || be.Errs[7] == nil {
+			t.Errorf("atOnce=%d: got error %#v, want jobs 3 and 7 to fail", atOnce, err)
+		} else if be.Error() != "square: 2/10 failed" {
+			t.Errorf("atOnce=%d: got message %q", atOnce, be.Error())
+		}
+	}
+}
+
+func TestParallel_failFast(t *testing.T) {
+	var started int32
+	oneStarted := make(chan struct{})
+	f := func(ctx context.Context, n int) (struct{}, error) {
+		atomic.AddInt32(&started, 1)
+		switch n {
+		case 0:
+			<-oneStarted
+			return struct{}{}, fmt.Errorf("fail")
+		case 1:
+			close(oneStarted)
+		}
+		// Running jobs are cancelled.
+		<-ctx.Done()
+		return struct{}{}, ctx.Err()
+	}
+	jobs := make([]int, 10)
+	for i := range jobs {
+		jobs[i] = i
+	}
+	results := parallel(context.Background(), jobs, poolOptions{atOnce: 2, failFast: true}, f)
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("%d jobs started, want 2", n)
+	}
+	for i, r := range results[2:] {
+		if r.err != errSkipped {
+			t.Errorf("job %d: got %v, want errSkipped", i+2, r.err)
+		}
+	}
+
+	// Jobs aren't started after the caller's context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results = parallel(ctx, jobs, poolOptions{atOnce: 2}, f)
+	err := batchError(ctx, "", results)
+	if be, ok := err.(*BatchError); !ok || len(be.Errs) != 10 || !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want all jobs cancelled", err)
+	}
+	if n := atomic.LoadInt32(&started); n != 2 {
+		t.Errorf("%d jobs started after cancellation, want none", n-2)
+	}
+}
+
+func TestDownloadVines_progress(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	var mu sync.Mutex
+	var events []Event
+	Progress = func(e Event) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	defer func() { Progress = nil }()
+
+	vines := []Vine{
+		{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")},
+		{UUID: "missing", URL: archive.VideoURL("missing")},
+	}
+	DownloadVines(vines)
+
+	if len(events) == 0 || events[0].Kind != StageStarted || events[0].Total != 2 {
+		t.Fatalf("first event isn't the start of a 2-job stage: %+v", events)
+	}
+	if last := events[len(events)-1]; last.Kind != StageFinished {
+		t.Errorf("last event isn't the end of the stage: %+v", last)
+	}
+	got := map[string][]EventKind{}
+	var transferred int64
+	for _, e := range events {
+		if e.Stage != "download" || e.Time.IsZero() {
+			t.Errorf("event without a stage or time: %+v", e)
+		}
+		switch e.Kind {
+		case JobStarted, JobFinished, JobFailed:
+			got[e.Job] = append(got[e.Job], e.Kind)
+		case Transfer:
+			if e.Job != "b9KOOWX7HUx" || e.Size != int64(len(crkrtest.TinyMP4)) {
+				t.Errorf("unexpected transfer: %+v", e)
+			}
+			transferred = e.Bytes
+		}
+	}
+	want := map[string][]EventKind{
+		"b9KOOWX7HUx": {JobStarted, JobFinished},
+		"missing":     {JobStarted, JobFailed},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got job events %v, want %v", got, want)
+	}
+	if transferred != int64(len(crkrtest.TinyMP4)) {
+		t.Errorf("last transfer event has %d bytes, want %d", transferred, len(crkrtest.TinyMP4))
+	}
+}
+
+func TestFailureReport(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	report := &FailureReport{Command: "get", Args: []string{"-thumbnails", "x.m3u"}, Dir: "/vines"}
+	Progress = report.Record
+	defer func() { Progress = nil }()
+
+	vines := []Vine{
+		{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")},
+		{UUID: "missing", Title: "gone", URL: archive.VideoURL("missing")},
+	}
+	DownloadVines(vines)
+	// Failing again replaces the error rather than adding a failure.
+	report.Record(Event{Kind: JobFailed, Stage: "download", Job: "missing", Err: "again"})
+	report.AttachVines(vines)
+
+	if len(report.Failures) != 1 {
+		t.Fatalf("got failures %+v, want one", report.Failures)
+	}
+	f := report.Failures[0]
+	if f.Stage != "download" || f.ID != "missing" || f.Err != "again" || f.Attempts != 1 {
+		t.Errorf("unexpected failure %+v", f)
+	}
+	if f.Vine == nil || f.Vine.Title != "gone" {
+		t.Errorf("vine not attached: %+v", f.Vine)
+	}
+	if !report.Failed("download", "missing") || report.Failed("download", "b9KOOWX7HUx") {
+		t.Error("Failed disagrees with Failures")
+	}
+
+	err := report.Write("report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := ReadFailureReport("report.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prev.Command != "get" || prev.Dir != "/vines" || !reflect.DeepEqual(prev.Args, report.Args) || !reflect.DeepEqual(prev.Failures, report.Failures) {
+		t.Errorf("read %+v, wrote %+v", prev, report)
+	}
+
+	next := &FailureReport{}
+	next.Record(Event{Kind: JobFailed, Stage: "download", Job: "missing", Err: "again"})
+	next.Record(Event{Kind: JobFailed, Stage: "download", Job: "other", Err: "new"})
+	next.CountAttempts(prev)
+	if next.Failures[0].Attempts != 2 || next.Failures[1].Attempts != 1 {
+		t.Errorf("got failures %+v, want 2 and 1 attempts", next.Failures)
+	}
+}
+
+func TestFFmpegProgress(t *testing.T) {
+	var events []Event
+	Progress = func(e Event) { events = append(events, e) }
+	defer func() { Progress = nil }()
+
+	ctx := withJob(context.Background(), "render", "a.mp4")
+	p := &ffmpegProgress{ctx: ctx, duration: 4 * time.Second}
+	io.WriteString(p, "frame=10\nout_time_us=10")
+	io.WriteString(p, "00000\nout_time=00:00:01.000000\nprogress=continue\n")
+	io.WriteString(p, "out_time_us=3000000\nprogress=end\n")
+	// The second update is too soon after the first to be reported.
+	want := []float64{25, 100}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want percents %v", events, want)
+	}
+	for i, e := range events {
+		if e.Kind != Encode || e.Stage != "render" || e.Job != "a.mp4" || e.Percent != want[i] {
+			t.Errorf("event %d: got %+v, want %v%%", i, e, want[i])
+		}
+	}
+}
+
+func TestDownloadVines_notFound(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	vine := Vine{UUID: "missing", URL: archive.VideoURL("missing")}
+	err := DownloadVines([]Vine{vine})
+	if err == nil {
+		t.Error("error expected for missing video")
+	}
+	for _, name := range []string{"missing.mp4", "missing.mp4.part"} {
+		if FileExists(name) {
+			t.Errorf("%s exists after failed download", name)
+		}
+	}
+}
+
+func TestDownloadVines_resume(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	vine := Vine{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")}
+	// Mark the partial data so it's clear the rest was appended to it rather
+	// than downloaded from the start.
+	n := len(crkrtest.TinyMP4) / 2
+	partial := bytes.Repeat([]byte{'x'}, n)
+	err := ioutil.WriteFile(vine.VideoFilename()+".part", partial, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadVinesOptions([]Vine{vine}, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(vine.VideoFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(partial, crkrtest.TinyMP4[n:]...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("resumed download has %d bytes, want %d with the partial prefix", len(got), len(want))
+	}
+	if FileExists(vine.VideoFilename() + ".part") {
+		t.Error(".part file left after download")
+	}
+}
+
+func TestCheckVideos(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	ids := []string{"b9KOOWX7HUx", "bnmHnwVILKD", "MqEnHaJXg0g"}
+	vines := make([]Vine, len(ids))
+	for i, id := range ids {
+		vines[i] = Vine{UUID: id, URL: archive.VideoURL(id)}
+	}
+	vines[2].URL = archive.VideoURL("b9KOOWX7HUx")
+	err := DownloadVines(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(crkrtest.TinyMP4)
+	for _, v := range vines {
+		if v.Size != int64(len(crkrtest.TinyMP4)) || v.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s: size %d, sha256 %s not recorded", v.UUID, v.Size, v.SHA256)
+		}
+	}
+
+	err = os.Remove(vines[0].VideoFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(vines[1].VideoFilename(), []byte("truncated"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems, err := CheckVideos(context.Background(), vines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("got problems %v, want missing %s and corrupt %s", problems, ids[0], ids[1])
+	}
+	if p := problems[0]; p.Vine.UUID != ids[0] || !p.Missing {
+		t.Errorf("got %q, want %s missing", p, ids[0])
+	}
+	if p := problems[1]; p.Vine.UUID != ids[1] || p.Missing {
+		t.Errorf("got %q, want %s corrupt", p, ids[1])
+	}
+}
+
+func TestDownloadVines_keepChecksum(t *testing.T) {
+	useFakeArchive(t)
+	chdirTemp(t)
+	vines, err := ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadVinesOptions(vines, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteAllVineMetadata(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(vines[0].VideoFilename(), []byte("corrupted"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Getting the vines again skips the existing videos, and mustn't record
+	// the corrupted video's checksum.
+	vines, err = ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadVinesOptions(vines, DownloadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteAllVineMetadata(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range vines {
+		vines[i], err = ReadVineMetadata(v.MetadataFilename())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err := CheckVideos(context.Background(), vines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Vine.UUID != vines[0].UUID || problems[0].Missing {
+		t.Errorf("got problems %v, want %s corrupt", problems, vines[0].UUID)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		in           string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-9/*", 0, -1, true},
+		{"bytes */200", -1, 200, true},
+		{"bytes 100/200", 0, 0, false},
+		{"items 0-9/10", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, total, ok := parseContentRange(test.in)
+		if start != test.start || total != test.total || ok != test.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %t; want %d, %d, %t",
+				test.in, start, total, ok, test.start, test.total, test.ok)
+		}
+	}
+}
+
+func TestLocalArchive(t *testing.T) {
+	archive := crkrtest.NewArchive()
+	archive.Close()
+	dir := chdirTemp(t)
+	mirror := filepath.Join(dir, "mirror", "archive.vine.co")
+	err := archive.WriteDir(mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarball := filepath.Join(dir, "mirror.tar.gz")
+	err = exec.Command("tar", "-czf", tarball, "-C", filepath.Join(dir, "mirror"), ".").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{filepath.Join(dir, "mirror"), tarball} {
+		la, err := OpenArchive(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vines, err := la.UserVines("56")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vines) != 5 {
+			t.Errorf("%s: got %d vines, want 5", name, len(vines))
+		}
+		// Repeated vines are imported once and both get the checksum.
+		imported, err := la.ImportVideos(context.Background(), append(vines, vines[0]), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imported) != 6 {
+			t.Errorf("%s: got %d imported vines, want 6", name, len(imported))
+		}
+		sum := sha256.Sum256(crkrtest.TinyMP4)
+		for _, vine := range imported {
+			b, err := ioutil.ReadFile(vine.VideoFilename())
+			if err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(b, crkrtest.TinyMP4) {
+				t.Errorf("%s: unexpected contents %q", vine.VideoFilename(), b)
+			}
+			if vine.Size != int64(len(crkrtest.TinyMP4)) || vine.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: checksum not recorded: %d %q", vine.UUID, vine.Size, vine.SHA256)
+			}
+		}
+		for _, vine := range imported {
+			os.Remove(vine.VideoFilename())
+		}
+		all, err := la.AllVines()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(all) != len(archive.Posts) {
+			t.Errorf("%s: got %d vines, want %d", name, len(all), len(archive.Posts))
+		}
+		err = la.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	dir := chdirTemp(t)
+	src := filepath.Join(dir, "src.mp4")
+	writeFile(t, src, "video")
+	err := importFile(filepath.Join("out", "a.mp4"), src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join("out", "a.mp4"))
+	if err != nil || string(b) != "video" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	// A failed copy leaves nothing behind for later runs to mistake for
+	// an imported video.
+	err = importFile("b.mp4", filepath.Join(dir, "missing.mp4"))
+	if err == nil {
+		t.Error("want error for missing source")
+	}
+	for _, name := range []string{"b.mp4", "b.mp4.part", filepath.Join("out", "a.mp4.part")} {
+		if FileExists(name) {
+			t.Errorf("%s exists", name)
+		}
+	}
+}
+
+func TestHTTPGet_retry(t *testing.T) {
+	archive := useFakeArchive(t)
+	origRetry := Retry
+	Retry = RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	defer func() { Retry = origRetry }()
+
+	path := "/posts/b9KOOWX7HUx.json"
+	archive.Fail(path, 1, http.StatusServiceUnavailable, "0")
+	archive.Fail(path, 1, http.StatusBadGateway, "")
+	_, err := ExtractVines("https://vine.co/v/b9KOOWX7HUx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := archive.Requests(path); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	// Give up after MaxAttempts.
+	path = "/posts/bnmHnwVILKD.json"
+	archive.Fail(path, 3, http.StatusInternalServerError, "")
+	_, err = ExtractVines("https://vine.co/v/bnmHnwVILKD")
+	if err == nil {
+		t.Error("error expected after exhausting retries")
+	}
+	if n := archive.Requests(path); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+
+	// Don't wait longer than MaxBackoff.
+	path = "/videos/bnmHnwVILKD.mp4"
+	archive.Fail(path, 1, http.StatusTooManyRequests, "3600")
+	err = Vine{URL: archive.VideoURL("bnmHnwVILKD")}.Download(ioutil.Discard)
+	if err == nil {
+		t.Error("error expected for excessive Retry-After")
+	}
+
+	// Don't retry permanent failures.
+	path = "/posts/nonexistent.json"
+	_, err = ExtractVines("https://vine.co/v/nonexistent")
+	if err == nil {
+		t.Error("error expected for nonexistent post")
+	}
+	if n := archive.Requests(path); n != 1 {
+		t.Errorf("got %d requests, want 1", n)
+	}
+}
+
+func TestHTTPGet_permanentErrors(t *testing.T) {
+	origRetry, origClient := Retry, Client
+	Retry = RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	defer func() { Retry, Client = origRetry, origClient }()
+
+	// The server's certificate isn't trusted.
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsSrv.Close()
+	transport := &countingTransport{base: &http.Transport{}}
+	Client = &http.Client{Transport: transport}
+	_, err := httpGet(context.Background(), tlsSrv.URL, nil)
+	if err == nil {
+		t.Error("error expected for untrusted certificate")
+	}
+	if transport.requests != 1 {
+		t.Errorf("TLS error: got %d requests, want 1", transport.requests)
+	}
+
+	// Refused connections might work later.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close()
+	transport = &countingTransport{base: &http.Transport{}}
+	Client = &http.Client{Transport: transport}
+	_, err = httpGet(context.Background(), srv.URL, nil)
+	if err == nil {
+		t.Error("error expected for closed server")
+	}
+	if transport.requests != 3 {
+		t.Errorf("refused connection: got %d requests, want 3", transport.requests)
+	}
+
+	dnsErr := &url.Error{Op: "Get", URL: "http://vine.invalid/", Err: &net.OpError{
+		Op:  "dial",
+		Net: "tcp",
+		Err: &net.DNSError{Err: "no such host", Name: "vine.invalid", IsNotFound: true},
+	}}
+	if retryable(context.Background(), nil, dnsErr) {
+		t.Error("unknown host retried")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	// The handler runs in the server's goroutines.
+	var mu sync.Mutex
+	var ua, header, host string
+	lastRequest := func() (string, string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return ua, header, host
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ua, header, host = r.UserAgent(), r.Header.Get("X-Archive-Team"), r.URL.Host
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsSrv.Close()
+	dir := chdirTemp(t)
+
+	get := func(cfg ClientConfig, url string) error {
+		c, err := NewClient(cfg)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Get(url)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	// User-Agent and extra headers.
+	cfg := ClientConfig{Proxy: "direct", Header: http.Header{"X-Archive-Team": {"yes"}}}
+	if err := get(cfg, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if gotUA, gotHeader, _ := lastRequest(); gotUA != DefaultUserAgent || gotHeader != "yes" {
+		t.Errorf("got User-Agent %q and header %q, want %q and yes", gotUA, gotHeader, DefaultUserAgent)
+	}
+	cfg.UserAgent = "archivist/1.0"
+	if err := get(cfg, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if gotUA, _, _ := lastRequest(); gotUA != "archivist/1.0" {
+		t.Errorf("got User-Agent %q, want archivist/1.0", gotUA)
+	}
+
+	// Timeouts.
+	cfg.Timeout = 50 * time.Millisecond
+	if err := get(cfg, srv.URL+"/slow"); err == nil {
+		t.Error("error expected for slow response")
+	}
+
+	// Requests go through the proxy, which sees the absolute URL.
+	cfg = ClientConfig{Proxy: srv.URL}
+	if err := get(cfg, "http://archive.invalid/posts/b9KOOWX7HUx.json"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, gotHost := lastRequest(); gotHost != "archive.invalid" {
+		t.Errorf("proxy got host %q, want archive.invalid", gotHost)
+	}
+	if _, err := NewClient(ClientConfig{Proxy: "ftp://proxy"}); err == nil {
+		t.Error("error expected for ftp proxy")
+	}
+
+	// A CA file is needed to trust the TLS server's certificate.
+	cfg = ClientConfig{Proxy: "direct"}
+	if err := get(cfg, tlsSrv.URL); err == nil {
+		t.Error("error expected for untrusted certificate")
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsSrv.Certificate().Raw})
+	cfg.CAFile = filepath.Join(dir, "ca.pem")
+	writeFile(t, cfg.CAFile, string(cert))
+	if err := get(cfg, tlsSrv.URL); err != nil {
+		t.Error(err)
+	}
+	writeFile(t, cfg.CAFile, "not a certificate")
+	if _, err := NewClient(cfg); err == nil {
+		t.Error("error expected for CA file without certificates")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *RateLimiter
+	ctx := context.Background()
+	nilLimiter.Wait(ctx)
+	for _, rate := range []float64{0, -1} {
+		if l := NewRateLimiter(rate, 1); l != nil {
+			t.Errorf("rate %v: got a limiter, want nil for no limit", rate)
+		}
+	}
+
+	l := NewRateLimiter(200, 2)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.Wait(ctx)
+	}
+	// The first two are allowed immediately and the next four at 5ms
+	// intervals.
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("6 events took %s, want at least 20ms", elapsed)
+	}
+
+	l = NewRateLimiter(1000, 100)
+	start = time.Now()
+	n, err := io.Copy(ioutil.Discard, limitedReader{ctx, bytes.NewReader(make([]byte, 150)), l})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 150 {
+		t.Errorf("read %d bytes, want 150", n)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("150 bytes took %s, want at least 50ms", elapsed)
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	archive := useFakeArchive(t)
+	dir := chdirTemp(t)
+	cache, err := NewHTTPCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Cache = cache
+	defer func() { Cache = nil }()
+
+	for i := 0; i < 2; i++ {
+		vines, err := ExtractVines("https://vine.co/u/76")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vines) != 1 || vines[0].Title != "Chicken." {
+			t.Errorf("got %v, want Chicken.", vines)
+		}
+	}
+	for _, path := range []string{"/profiles/76.json", "/posts/b9KOOWX7HUx.json"} {
+		if n := archive.NotModified(path); n != 1 {
+			t.Errorf("%s: got %d 304 responses, want 1", path, n)
+		}
+	}
 
-func TestExtractVines_singleVine(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
+	// Changed responses replace cached ones.
+	post := archive.Posts["b9KOOWX7HUx"]
+	post.Description = "Chicken?"
+	archive.Posts["b9KOOWX7HUx"] = post
+	vines, err := ExtractVines("https://vine.co/v/b9KOOWX7HUx")
+	if err != nil {
+		t.Fatal(err)
 	}
-	got, err := ExtractVines("https://vine.co/v/b9KOOWX7HUx")
+	if vines[0].Title != "Chicken?" {
+		t.Errorf("got title %q, want updated title", vines[0].Title)
+	}
+
+	removed, err := cache.Prune(time.Hour)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	want := []Vine{
-		{
-			Title:      "Chicken.",
-			Uploader:   "Jack",
-			UploaderID: "76",
-			URL:        "http://v.cdn.vine.co/v/videos/7508FF74-000E-48F3-9E5E-D7218D5F8FFB-7580-000002B248D861FF_1.1.mp4?versionId=6LYxpZTqmX86aZ9uq5b8e.PqOWi45U9T",
-			UUID:       "b9KOOWX7HUx",
-			Created:    time.Date(2013, 5, 19, 21, 12, 31, 0, time.UTC),
-		},
+	if removed != 0 {
+		t.Errorf("pruned %d fresh entries", removed)
+	}
+	removed, err = cache.Prune(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 2 {
+		t.Errorf("pruned %d entries, want 2", removed)
+	}
+}
+
+type stubExtractor struct {
+	name   string
+	prefix string
+	calls  int
+}
+
+func (e *stubExtractor) Name() string          { return e.name }
+func (e *stubExtractor) Match(url string) bool { return strings.HasPrefix(url, e.prefix) }
+func (e *stubExtractor) Extract(url string) ([]Vine, error) {
+	e.calls++
+	if !e.Match(url) {
+		return nil, fmt.Errorf("unrecognized url: %s", url)
+	}
+	return []Vine{{Title: e.name, UUID: strings.TrimPrefix(url, e.prefix)}}, nil
+}
+
+// restoreExtractors unregisters extractors registered during a test.
+func restoreExtractors(t *testing.T) {
+	orig := registeredExtractors()
+	t.Cleanup(func() {
+		extractors.Lock()
+		extractors.list = orig
+		extractors.Unlock()
+	})
+}
+
+func TestExtractVines_registered(t *testing.T) {
+	restoreExtractors(t)
+	a := &stubExtractor{name: "a", prefix: "stub-a:"}
+	b := &stubExtractor{name: "b", prefix: "stub-b:"}
+	RegisterExtractor(a)
+	RegisterExtractor(b)
+
+	got, err := ExtractVines("stub-b:xyz")
+	if err != nil {
+		t.Fatal(err)
 	}
+	want := []Vine{{Title: "b", UUID: "xyz"}}
 	if !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+	if a.calls != 0 {
+		t.Errorf("non-matching extractor called %d times", a.calls)
+	}
+
+	_, err = ExtractVines("stub-c:xyz")
+	if err == nil {
+		t.Fatal("error expected for unmatched url")
+	}
+	if a.calls != 1 || b.calls != 2 {
+		t.Errorf("fallback calls: got a=%d b=%d, want a=1 b=2", a.calls, b.calls)
+	}
 }
 
-func TestExtractVines_userPosts(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
+func TestAssignIDs(t *testing.T) {
+	vines := []Vine{
+		{URL: "http://example.com/a.mp4"},
+		{URL: "http://example.com/b.mp4"},
+		{URL: "http://example.com/c.mp4", Permalink: "https://vine.co/v/b9KOOWX7HUx"},
+		{URL: "http://example.com/d.mp4", UUID: "keep"},
+		{Title: "no URLs"},
 	}
-	vines, err := ExtractVines("https://vine.co/u/56")
+	vines, err := assignIDs(vines)
+	if err == nil || len(vines) != 4 {
+		t.Errorf("got %d vines, %v; want the vine without URLs left out with an error", len(vines), err)
+	}
+	again, err := assignIDs([]Vine{{URL: "http://example.com/a.mp4"}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	wantLen := 63
-	if len(vines) != wantLen {
-		t.Errorf("got %d, want %d or more", len(vines), wantLen)
+	if vines[0].UUID != again[0].UUID {
+		t.Errorf("IDs differ between runs: %s, %s", vines[0].UUID, again[0].UUID)
 	}
-	wantTitles := []string{"le rain.", "spill", "UCB", "ballgame", "kinect"}
-	var missing []string
-	for _, title := range wantTitles {
-		found := false
-		for _, vine := range vines {
-			if vine.Title == title {
-				found = true
-			}
+	if vines[0].UUID == vines[1].UUID {
+		t.Errorf("different URLs got the same ID %s", vines[0].UUID)
+	}
+	if vines[2].UUID != "b9KOOWX7HUx" {
+		t.Errorf("got %s, want short ID from permalink", vines[2].UUID)
+	}
+	if vines[3].UUID != "keep" {
+		t.Errorf("existing ID replaced by %s", vines[3].UUID)
+	}
+}
+
+func TestCheckIDs(t *testing.T) {
+	archive := useFakeArchive(t)
+	chdirTemp(t)
+	vines := []Vine{
+		{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")},
+		{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("b9KOOWX7HUx")},
+	}
+	if err := checkIDs(vines); err != nil {
+		t.Errorf("duplicate vine treated as a collision: %s", err)
+	}
+	// Repeats are downloaded once, and both get the checksum.
+	var mu sync.Mutex
+	started := 0
+	Progress = func(e Event) {
+		if e.Kind == JobStarted {
+			mu.Lock()
+			started++
+			mu.Unlock()
 		}
-		if !found {
-			missing = append(missing, title)
+	}
+	err := DownloadVines(vines)
+	Progress = nil
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started != 1 {
+		t.Errorf("duplicate vine downloaded %d times", started)
+	}
+	if vines[0].SHA256 == "" || vines[1].SHA256 != vines[0].SHA256 {
+		t.Errorf("checksums not recorded for both copies: %q, %q", vines[0].SHA256, vines[1].SHA256)
+	}
+	if err := WriteAllVineMetadata(vines[:1]); err != nil {
+		t.Fatal(err)
+	}
+	// A vine with the same ID as one already written but a different URL
+	// collides with it.
+	other := []Vine{{UUID: "b9KOOWX7HUx", URL: archive.VideoURL("bnmHnwVILKD")}}
+	if err := WriteAllVineMetadata(other); err == nil {
+		t.Error("error expected for collision with metadata on disk")
+	}
+	os.Remove("b9KOOWX7HUx.json")
+	os.Remove("b9KOOWX7HUx.mp4")
+
+	vines[1].URL = archive.VideoURL("bnmHnwVILKD")
+	if err := DownloadVines(vines); err == nil {
+		t.Error("error expected for colliding IDs")
+	}
+	if err := WriteAllVineMetadata(vines); err == nil {
+		t.Error("error expected for colliding IDs")
+	}
+	files, _ := filepath.Glob("*")
+	if len(files) > 0 {
+		t.Errorf("files written despite collision: %s", files)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	vine := Vine{
+		Title:      "Guys be like #superbowl",
+		Uploader:   "mielmonster",
+		UploaderID: "973499529959968768",
+		Created:    time.Date(2015, 2, 2, 3, 0, 0, 0, time.UTC),
+		Loops:      5000000,
+		Likes:      100,
+	}
+	day := func(y, m, d int) time.Time { return time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"zero", Filter{}, true},
+		{"since before", Filter{Since: day(2015, 2, 1)}, true},
+		{"since after", Filter{Since: day(2015, 2, 3)}, false},
+		{"until after", Filter{Until: day(2015, 2, 3)}, true},
+		{"until exact", Filter{Until: vine.Created}, false},
+		{"match", Filter{Match: regexp.MustCompile(`#superbowl`)}, true},
+		{"no match", Filter{Match: regexp.MustCompile(`^Girls`)}, false},
+		{"exclude", Filter{Exclude: regexp.MustCompile(`(?i)guys`)}, false},
+		{"uploader name", Filter{Uploader: "MielMonster"}, true},
+		{"uploader ID", Filter{Uploader: "973499529959968768"}, true},
+		{"repost", Filter{Uploader: "dom"}, false},
+		{"min loops", Filter{MinLoops: 5000000}, true},
+		{"too few loops", Filter{MinLoops: 5000001}, false},
+		{"too few likes", Filter{MinLikes: 101}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Keep(vine); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
 		}
 	}
-	if len(missing) > 0 {
-		t.Errorf("missing titles: %s", strings.Join(missing, ", "))
+}
+
+func TestLimitVines(t *testing.T) {
+	vines := []Vine{{UUID: "a"}, {UUID: "b"}, {UUID: "c"}}
+	tests := []struct {
+		offset, limit int
+		want          string
+	}{
+		{0, 0, "abc"},
+		{1, 0, "bc"},
+		{0, 2, "ab"},
+		{1, 1, "b"},
+		{2, 5, "c"},
+		{5, 1, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		for _, v := range LimitVines(vines, test.offset, test.limit) {
+			got += v.UUID
+		}
+		if got != test.want {
+			t.Errorf("LimitVines(offset=%d, limit=%d): got %q, want %q", test.offset, test.limit, got, test.want)
+		}
 	}
 }
 
-func TestExtractVines_apiError(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping long test")
+func TestLayout(t *testing.T) {
+	vine := Vine{
+		Title:      "what: a/b? \"day\"\n",
+		Uploader:   "../mielmonster",
+		UploaderID: "973499529959968768",
+		UUID:       "Mz2Wzi73VnI",
+		Created:    time.Date(2015, 2, 2, 3, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{DefaultPattern, "out/Mz2Wzi73VnI"},
+		// Slashes in fields don't make directories, only ones in the
+		// pattern do.
+		{`{{.Uploader}}/{{.Created.Format "2006-01-02"}}_{{.UUID}}`, "out/_mielmonster/2015-02-02_Mz2Wzi73VnI"},
+		{`{{.Title}}`, "out/what_ a_b_ _day__"},
+		{`{{.UploaderID}}/../../{{.UUID}}`, "out/973499529959968768/Mz2Wzi73VnI"},
+		{`{{.Title}}` + strings.Repeat("x", 300), "out/what_ a_b_ _day__" + strings.Repeat("x", maxNameLen-len("what_ a_b_ _day__"))},
+	}
+	for _, test := range tests {
+		l, err := NewLayout("out", test.pattern)
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		got, err := l.Base(vine)
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		if want := filepath.FromSlash(test.want); got != want {
+			t.Errorf("%s: got %q, want %q", test.pattern, got, want)
+		}
 	}
-	_, err := ExtractVines("https://vine.co/api/users/profiles/vanity/torbiak")
-	if err == nil {
-		t.Error("error expected for nonexistant vanity url")
+
+	// Characters that are special to ffmpeg are kept, since they're
+	// escaped when filenames are given to it, but Windows device names get
+	// an underscore.
+	odd := Vine{Title: "it's [a], b; c", Uploader: "con", UUID: "Mz2Wzi73VnI"}
+	oddTests := []struct {
+		pattern string
+		want    string
+	}{
+		{`{{.Title}}`, "out/it's [a], b; c"},
+		{`{{.Uploader}}/{{.UUID}}`, "out/con_/Mz2Wzi73VnI"},
+		{`{{.Uploader}}`, "out/con_"},
+		{`{{.Uploader}}.txt`, "out/con_.txt"},
+		{`{{.Uploader}}sole`, "out/console"},
+	}
+	for _, test := range oddTests {
+		l, err := NewLayout("out", test.pattern)
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		got, err := l.Base(odd)
+		if err != nil {
+			t.Errorf("%s: %s", test.pattern, err)
+			continue
+		}
+		if want := filepath.FromSlash(test.want); got != want {
+			t.Errorf("%s: got %q, want %q", test.pattern, got, want)
+		}
+	}
+
+	for _, bad := range []string{"{{.Nope}}", "{{", "{{/* empty */}}"} {
+		if _, err := NewLayout("", bad); err == nil {
+			t.Errorf("%s: error expected", bad)
+		}
+	}
+}
+
+func TestLayout_download(t *testing.T) {
+	useFakeArchive(t)
+	dir := chdirTemp(t)
+	origOutput := Output
+	defer func() { Output = origOutput }()
+	var err error
+	Output, err = NewLayout("out", `{{.Uploader}}/{{.UUID}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vines, err := ExtractVines("https://vine.co/u/56")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DownloadVines(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteAllVineMetadata(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playlist := filepath.Join("out", "dom.m3u")
+	err = WriteM3UFile(playlist, vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "\ndom/"+vines[0].UUID+".mp4\n") {
+		t.Errorf("playlist paths aren't relative to the playlist:\n%s", b)
+	}
+
+	// Vines read back from metadata find their files regardless of Output.
+	Output = Layout{}
+	got, err := ReadMetadataForPlaylist(playlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range got {
+		want := filepath.Join("out", "dom", v.UUID+".mp4")
+		if v.VideoFilename() != want {
+			t.Errorf("got %s, want %s", v.VideoFilename(), want)
+		}
+		if !FileExists(v.VideoFilename()) {
+			t.Errorf("%s missing", v.VideoFilename())
+		}
+	}
+
+	// Vines must not share files.
+	Output, _ = NewLayout(dir, "{{.Uploader}}")
+	if err := WriteAllVineMetadata(vines); err == nil {
+		t.Error("error expected for colliding filenames")
 	}
 }
 
@@ -155,6 +1587,21 @@ func TestVineSubtitles(t *testing.T) {
 	if got != want {
 		t.Errorf("got %q, want %q", got, want)
 	}
+
+	vine.Venue = "The Office"
+	vine.Loops = 42
+	vine.Hashtags = []string{"avengers", "comedy"}
+	vine.Created = time.Date(2016, 2, 5, 0, 0, 0, 0, time.UTC)
+	tmpl := template.Must(template.New("subtitles").Parse(
+		`{{.Title}} at {{.Venue}} on {{.Created.Format "2006-01-02"}} ({{.Loops}} loops){{range .Hashtags}} #{{.}}{{end}}`))
+	got, err = vine.Subtitles(2*time.Second, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "1\n00:00:00,000 --> 00:00:02,000\nIdiots Assemble! at The Office on 2016-02-05 (42 loops) #avengers #comedy\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
 }
 
 func TestReadM3U(t *testing.T) {
@@ -174,6 +1621,14 @@ bnmHnwVILKD.mp4`
 	}
 }
 
+func TestSubtitlesFilter(t *testing.T) {
+	got := subtitlesFilter(`out/it's: a [b],c;d\e.srt`, "Arial", 24)
+	want := `subtitles=f=out/it\\\'s\\: a \[b\]\,c\;d\\\\e.srt:force_style=FontName=Arial\,Fontsize=24`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
 func TestRenderAllSubtitles(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long test")
@@ -248,6 +1703,14 @@ func videoHash(filepath string) (string, error) {
 	return buf.String(), err
 }
 
+func TestConcatQuote(t *testing.T) {
+	got := concatQuote("/tmp/it's.ts")
+	want := `'/tmp/it'\''s.ts'`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
 func TestConcatVideos(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long test")
@@ -283,6 +1746,69 @@ func filesize(t *testing.T, filename string) int64 {
 	return info.Size()
 }
 
+func TestManifestPlan(t *testing.T) {
+	archive := useFakeArchive(t)
+	m := &Manifest{URL: "https://vine.co/dom"}
+	plan, err := m.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.New) != 5 || len(plan.Gone) != 0 {
+		t.Fatalf("first sync: got %d new, %v gone; want 5 new", len(plan.New), plan.Gone)
+	}
+	m.Add(plan.New)
+
+	// One post is deleted and another is added.
+	profile := archive.Profiles["56"]
+	profile.Posts = append([]string{"bnmHnwVILKD"}, profile.Posts[1:]...)
+	archive.Profiles["56"] = profile
+	before := archive.Requests("/posts/hEDd9ZVPIrj.json")
+	plan, err = m.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.New) != 1 || plan.New[0].UUID != "bnmHnwVILKD" {
+		t.Errorf("got new %v, want bnmHnwVILKD", plan.New)
+	}
+	if !reflect.DeepEqual(plan.Gone, []string{"hwUV6p0mvFD"}) {
+		t.Errorf("got gone %v, want hwUV6p0mvFD", plan.Gone)
+	}
+	if n := archive.Requests("/posts/hEDd9ZVPIrj.json"); n != before {
+		t.Error("metadata fetched again for a synced post")
+	}
+
+	m.URL = "https://vine.co/jack"
+	if _, err := m.Plan(context.Background()); err == nil {
+		t.Error("error expected for a different user")
+	}
+}
+
+func TestUpdateM3U(t *testing.T) {
+	in := "#EXTM3U\n#EXTINF:-1,b: moved to the top\nb.mp4\na.mp4\n"
+	vines := []Vine{{UUID: "c", Uploader: "u", Title: "new"}, {UUID: "a"}}
+	out := &bytes.Buffer{}
+	err := UpdateM3U(out, strings.NewReader(in), vines, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "#EXTM3U\n#EXTINF:-1,u: new\nc.mp4\n#EXTINF:-1,b: moved to the top\nb.mp4\na.mp4\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	// Entries in subdirectories match however they're written.
+	in = "#EXTM3U\n./sub/a.mp4\n"
+	vines = []Vine{{UUID: "a", base: filepath.Join("sub", "a")}}
+	out.Reset()
+	err = UpdateM3U(out, strings.NewReader(in), vines, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != in {
+		t.Errorf("got %q, want %q", out.String(), in)
+	}
+}
+
 func TestHardSubM3U(t *testing.T) {
 	dir, err := ioutil.TempDir("", "crkr_whsm")
 	if err != nil {
@@ -364,6 +1890,14 @@ func TestMetadataCodec(t *testing.T) {
 			URL:      "http://v.cdn.vine.co/v/videos/7508FF74-000E-48F3-9E5E-D7218D5F8FFB-7580-000002B248D861FF_1.1.mp4?versionId=6LYxpZTqmX86aZ9uq5b8e.PqOWi45U9T",
 			UUID:     "b9KOOWX7HUx",
 			Created:  time.Date(2013, 5, 19, 21, 12, 31, 0, time.UTC),
+			Loops:    1234567,
+			Venue:    "Twitter HQ",
+			Hashtags: []string{"chicken"},
+			Mentions: []Mention{{UserID: "56", Username: "dom"}},
+			Explicit: true,
+			Size:     1234,
+			SHA256:   "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+			Verified: time.Date(2017, 1, 17, 12, 0, 0, 0, time.UTC),
 		},
 	}
 	err = WriteAllVineMetadata(want)
@@ -385,11 +1919,224 @@ func TestMetadataCodec(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// Vines read from metadata keep track of where their files are.
+	for i := range want {
+		want[i].base = filepath.Join(dir, want[i].UUID)
+	}
 	if !reflect.DeepEqual(want, got) {
 		t.Fatalf("want %v, got %v", want, got)
 	}
 }
 
+func TestReadVineMetadata_old(t *testing.T) {
+	dir := chdirTemp(t)
+	// Metadata as written before loop counts, venues, etc, were recorded.
+	old := `{"Title":"Chicken.","Uploader":"Jack","UploaderID":"76","URL":"http://v.cdn.vine.co/v/videos/chicken.mp4","UUID":"b9KOOWX7HUx","Created":"2013-05-19T21:12:31Z"}`
+	file := filepath.Join(dir, "b9KOOWX7HUx.json")
+	writeFile(t, file, old)
+	got, err := ReadVineMetadata(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Vine{
+		Title:      "Chicken.",
+		Uploader:   "Jack",
+		UploaderID: "76",
+		URL:        "http://v.cdn.vine.co/v/videos/chicken.mp4",
+		UUID:       "b9KOOWX7HUx",
+		Created:    time.Date(2013, 5, 19, 21, 12, 31, 0, time.UTC),
+		base:       filepath.Join(dir, "b9KOOWX7HUx"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMigrateVineMetadata(t *testing.T) {
+	dir := chdirTemp(t)
+	old := `{"Title":"Chicken.","Uploader":"Jack","URL":"http://v.cdn.vine.co/v/videos/chicken.mp4","UUID":"b9KOOWX7HUx","Created":"2013-05-19T21:12:31Z"}`
+	file := filepath.Join(dir, "b9KOOWX7HUx.json")
+	writeFile(t, file, old)
+	writeFile(t, filepath.Join(dir, ManifestFilename), `{"UserID":"56"}`)
+
+	files, err := FindVineMetadata(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{file}) {
+		t.Errorf("found %q, want %q", files, file)
+	}
+	migrated, err := MigrateVineMetadata(file, false)
+	if err != nil || !migrated {
+		t.Fatalf("got %t, %v; want the file migrated", migrated, err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(`{"Version":1,"Title":"Chicken."`)) {
+		t.Errorf("unexpected migrated metadata %s", b)
+	}
+	vine, err := ReadVineMetadata(file)
+	if err != nil || vine.Title != "Chicken." || vine.UUID != "b9KOOWX7HUx" {
+		t.Errorf("read back %+v, %v", vine, err)
+	}
+	migrated, err = MigrateVineMetadata(file, false)
+	if err != nil || migrated {
+		t.Errorf("current file: got %t, %v; want it left alone", migrated, err)
+	}
+}
+
+func TestMigrateVineMetadata_unknownFields(t *testing.T) {
+	dir := chdirTemp(t)
+	tests := []struct {
+		json     string
+		strict   bool
+		migrated bool
+		err      string
+	}{
+		{`{"UUID":"a","URL":"u"}`, false, true, ""},
+		{`{"UUID":"a","URL":"u","Extra":1,"Other":2}`, false, false, "unknown fields: Extra, Other"},
+		{`{"Version":1,"UUID":"a","URL":"u","Extra":1}`, false, false, ""},
+		{`{"Version":1,"UUID":"a","URL":"u","Extra":1}`, true, false, "unknown fields: Extra"},
+	}
+	file := filepath.Join(dir, "a.json")
+	for _, test := range tests {
+		writeFile(t, file, test.json)
+		migrated, err := MigrateVineMetadata(file, test.strict)
+		if test.err == "" {
+			if err != nil || migrated != test.migrated {
+				t.Errorf("%s, strict %t: got %t, %v; want %t", test.json, test.strict, migrated, err, test.migrated)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s, strict %t: got error %v, want %q", test.json, test.strict, err, test.err)
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil || string(b) != test.json {
+			t.Errorf("%s, strict %t: file changed to %s, %v", test.json, test.strict, b, err)
+		}
+	}
+}
+
+func TestReadVineMetadata_versions(t *testing.T) {
+	dir := chdirTemp(t)
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"Version":1,"UUID":"a","Extra":1,"Other":2}`, ""},
+		{`{"UUID":"a"}`, ""},
+		{`{"Version":99,"UUID":"a"}`, "unsupported metadata version 99"},
+		{fmt.Sprintf(`{"Version":%d,"UUID":"a"}`, MetadataVersion+1), "unsupported metadata version"},
+	}
+	file := filepath.Join(dir, "a.json")
+	for _, test := range tests {
+		writeFile(t, file, test.json)
+		vine, err := ReadVineMetadata(file)
+		if test.err == "" {
+			if err != nil || vine.UUID != "a" {
+				t.Errorf("%s: got %+v, %v", test.json, vine, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want %q", test.json, err, test.err)
+		}
+	}
+}
+
+func TestWriteVineMetadata_newerVersion(t *testing.T) {
+	chdirTemp(t)
+	vine := Vine{UUID: "a", URL: "u"}
+	newer := fmt.Sprintf(`{"Version":%d,"UUID":"a","URL":"u","Added":1}`, MetadataVersion+1)
+	writeFile(t, vine.MetadataFilename(), newer)
+	if err := WriteVineMetadata(vine); err == nil {
+		t.Error("error expected for replacing a newer version")
+	}
+	b, err := ioutil.ReadFile(vine.MetadataFilename())
+	if err != nil || string(b) != newer {
+		t.Errorf("newer file changed to %s, %v", b, err)
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	dir := chdirTemp(t)
+	vines := []Vine{
+		{UUID: "a", Title: "cat", Uploader: "Jack", Created: time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC), Loops: 10},
+		{UUID: "b", Title: "dog", Uploader: "Jack", Created: time.Date(2013, 3, 1, 0, 0, 0, 0, time.UTC), Loops: 30},
+		{UUID: "c", Title: "cat again", Uploader: "dom", Created: time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC), Loops: 20},
+	}
+	err := WriteAllVineMetadata(vines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range vines {
+		writeFile(t, v.VideoFilename(), "")
+	}
+	catalogFile := filepath.Join(dir, "catalog", "catalog.json")
+	err = UpdateCatalog(catalogFile, func(c *Catalog) error { return c.Add(vines) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rendering subtitles for a vine is recorded, and adding it again
+	// doesn't duplicate it.
+	writeFile(t, SubtitledVideoFilename("c.mp4"), "")
+	err = UpdateCatalog(catalogFile, func(c *Catalog) error {
+		if err := c.Refresh([]string{"c.mp4"}); err != nil {
+			return err
+		}
+		return c.Add(vines[:1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cat, err := ReadCatalog(catalogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cat.Entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(cat.Entries))
+	}
+	q := CatalogQuery{
+		Filter: Filter{Match: regexp.MustCompile("cat"), Since: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Sort:   "-loops",
+	}
+	got, err := cat.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].UUID != "c" || got[1].UUID != "a" {
+		t.Fatalf("got %+v, want c and a", got)
+	}
+	if got[0].Video != filepath.Join(dir, "c.mp4") || got[0].Subtitled != filepath.Join(dir, SubtitledVideoFilename("c.mp4")) || got[1].Subtitled != "" {
+		t.Errorf("unexpected paths in %+v", got)
+	}
+	got, err = cat.Query(CatalogQuery{Subtitled: true})
+	if err != nil || len(got) != 1 || got[0].UUID != "c" {
+		t.Errorf("subtitled: got %+v, %v", got, err)
+	}
+	got, err = cat.Query(CatalogQuery{Sort: "created", Offset: 1, Limit: 1})
+	if err != nil || len(got) != 1 || got[0].UUID != "a" {
+		t.Errorf("offset and limit: got %+v, %v", got, err)
+	}
+	if _, err := cat.Query(CatalogQuery{Sort: "bogus"}); err == nil {
+		t.Error("want error for unknown sort field")
+	}
+
+	// Vines from the catalog keep track of their files, even when the
+	// working directory changes.
+	os.Chdir(filepath.Join(dir, "catalog"))
+	b := &bytes.Buffer{}
+	err = WriteM3U(b, CatalogVines(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), filepath.ToSlash(filepath.Join(dir, "a.mp4"))) {
+		t.Errorf("playlist doesn't have a.mp4: %s", b)
+	}
+}
+
 func TestVideoDimensions(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping long test")
@@ -403,7 +2150,7 @@ func TestVideoDimensions(t *testing.T) {
 	wantW := 720
 	wantH := 720
 	writeBlankVideo(t, video, wantW, wantH)
-	gotW, gotH, err := videoDimensions(video)
+	gotW, gotH, err := videoDimensions(context.Background(), video)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -424,14 +2171,14 @@ func TestScale(t *testing.T) {
 	video := filepath.Join(dir, "orig.mp4")
 	writeBlankVideo(t, video, 480, 480)
 
-	err = scale(video)
+	err = scale(context.Background(), video)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	wantW := 720
 	wantH := 720
-	gotW, gotH, err := videoDimensions(video)
+	gotW, gotH, err := videoDimensions(context.Background(), video)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -463,7 +2210,7 @@ func TestScaleAll(t *testing.T) {
 	wantW := 720
 	wantH := 720
 	for _, video := range videos {
-		gotW, gotH, err := videoDimensions(video)
+		gotW, gotH, err := videoDimensions(context.Background(), video)
 		if err != nil {
 			t.Error(err)
 		}
@@ -0,0 +1,368 @@
+// Package crkrtest provides a fake Vine archive for testing code that fetches
+// vine metadata and videos without touching the network.
+//
+// Point creeperkeeper.ArchiveURL at Archive.URL and creeperkeeper.Client at
+// Archive.Client() to use it.
+package crkrtest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TinyMP4 is a minimal MP4 file: an ftyp box followed by an empty mdat box.
+// It's recognizable as MP4 but contains no streams.
+var TinyMP4 = []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2\x00\x00\x00\x08mdat")
+
+// TinyJPEG is a minimal JPEG file: just the start and end of image markers.
+var TinyJPEG = []byte("\xff\xd8\xff\xd9")
+
+// Post is an archived post, as served at /posts/<id>.json.
+type Post struct {
+	Description string `json:"description"`
+	Username    string `json:"username"`
+	UserIdStr   string `json:"userIdStr"`
+	Created     string `json:"created"`
+	// VideoURL defaults to the archive's /videos/<id>.mp4 if empty.
+	VideoURL  string `json:"videoUrl"`
+	Loops     int64  `json:"loops"`
+	Likes     int64  `json:"likes"`
+	Reposts   int64  `json:"reposts"`
+	Comments  int64  `json:"comments"`
+	VenueName string `json:"venueName,omitempty"`
+	// ThumbnailURL and AvatarURL default to the archive's
+	// /thumbs/<id>.jpg and /avatars/<userIdStr>.jpg if empty.
+	ThumbnailURL    string   `json:"thumbnailUrl"`
+	AvatarURL       string   `json:"avatarUrl"`
+	ExplicitContent int      `json:"explicitContent"`
+	PermalinkURL    string   `json:"permalinkUrl,omitempty"`
+	Entities        []Entity `json:"entities"`
+}
+
+// Entity is a hashtag or mention in a post's description.
+type Entity struct {
+	Type  string `json:"type"` // "tag" or "mention"
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// Profile is an archived user profile, as served at /profiles/<id>.json.
+type Profile struct {
+	Posts     []string `json:"posts"`
+	AvatarURL string   `json:"avatarUrl,omitempty"`
+}
+
+// Archive is an httptest server that mimics archive.vine.co, including
+// vanity name mappings at /vanities/<name>.json.
+type Archive struct {
+	*httptest.Server
+
+	// Posts, Profiles, Vanities and Videos may be modified by tests, but not
+	// while requests are being served.
+	Posts    map[string]Post    // short ID -> post
+	Profiles map[string]Profile // user ID -> profile
+	Vanities map[string]int64   // vanity name -> user ID
+	Videos   map[string][]byte  // short ID -> video
+	Thumbs   map[string][]byte  // short ID -> thumbnail
+	Avatars  map[string][]byte  // user ID -> avatar
+
+	mu          sync.Mutex
+	requests    map[string]int
+	notModified map[string]int
+	failures    map[string][]failure
+}
+
+type failure struct {
+	status     int
+	retryAfter string
+}
+
+// NewArchive starts a fake archive populated with fixtures.
+func NewArchive() *Archive {
+	a := NewEmptyArchive()
+	a.Posts = map[string]Post{
+		"b9KOOWX7HUx": {
+			Description:  "Chicken.",
+			Username:     "Jack",
+			UserIdStr:    "76",
+			Created:      "2013-05-19T21:12:31.000000",
+			Loops:        1234567,
+			Likes:        8910,
+			Reposts:      1112,
+			Comments:     131,
+			VenueName:    "Twitter HQ",
+			PermalinkURL: "https://vine.co/v/b9KOOWX7HUx",
+		},
+		"Mz2Wzi73VnI": {
+			Description:     "Guys be like #superbowl #sexism #relatable @dom",
+			Username:        "mielmonster",
+			UserIdStr:       "973499529959968768",
+			Created:         "2015-02-02T03:00:00.000000",
+			Loops:           5000000,
+			ExplicitContent: 1,
+			Entities: []Entity{
+				{Type: "tag", ID: 1, Title: "superbowl"},
+				{Type: "tag", ID: 2, Title: "sexism"},
+				{Type: "tag", ID: 3, Title: "relatable"},
+				{Type: "mention", ID: 56, Title: "dom"},
+			},
+		},
+		"bnmHnwVILKD": {Description: "Idiots Assemble!", Username: "Ben Willbond", UserIdStr: "910", Created: "2016-02-05T12:00:00.000000"},
+		"hwUV6p0mvFD": {Description: "le rain.", Username: "dom", UserIdStr: "56", Created: "2013-01-24T19:00:03.000000"},
+		"hEDd9ZVPIrj": {Description: "spill", Username: "dom", UserIdStr: "56", Created: "2013-02-11T03:41:12.000000"},
+		"bUzxUmhFZj6": {Description: "UCB", Username: "dom", UserIdStr: "56", Created: "2013-04-02T23:15:54.000000"},
+		"b3pgUrpLaEV": {Description: "ballgame", Username: "dom", UserIdStr: "56", Created: "2013-06-30T20:20:01.000000"},
+		"bDTZ0BIxn5t": {Description: "kinect", Username: "dom", UserIdStr: "56", Created: "2013-08-17T16:05:44.000000"},
+	}
+	a.Profiles = map[string]Profile{
+		"76":  {Posts: []string{"b9KOOWX7HUx"}},
+		"56":  {Posts: []string{"hwUV6p0mvFD", "hEDd9ZVPIrj", "bUzxUmhFZj6", "b3pgUrpLaEV", "bDTZ0BIxn5t"}},
+		"910": {Posts: []string{"bnmHnwVILKD"}},
+
+		"973499529959968768": {Posts: []string{"Mz2Wzi73VnI"}},
+	}
+	a.Vanities = map[string]int64{
+		"jack": 76,
+		"dom":  56,
+	}
+	for id, post := range a.Posts {
+		a.Videos[id] = TinyMP4
+		a.Thumbs[id] = TinyJPEG
+		a.Avatars[post.UserIdStr] = TinyJPEG
+	}
+	return a
+}
+
+// NewEmptyArchive starts a fake archive with no posts, profiles or videos.
+func NewEmptyArchive() *Archive {
+	a := &Archive{
+		Posts:       map[string]Post{},
+		Profiles:    map[string]Profile{},
+		Vanities:    map[string]int64{},
+		Videos:      map[string][]byte{},
+		Thumbs:      map[string][]byte{},
+		Avatars:     map[string][]byte{},
+		requests:    map[string]int{},
+		notModified: map[string]int{},
+		failures:    map[string][]failure{},
+	}
+	a.Server = httptest.NewServer(http.HandlerFunc(a.serveHTTP))
+	return a
+}
+
+// VideoURL returns the URL a post's video is served at by default.
+func (a *Archive) VideoURL(id string) string {
+	return a.URL + "/videos/" + id + ".mp4"
+}
+
+// ThumbnailURL returns the URL a post's thumbnail is served at by default.
+func (a *Archive) ThumbnailURL(id string) string {
+	return a.URL + "/thumbs/" + id + ".jpg"
+}
+
+// AvatarURL returns the URL a user's avatar is served at by default.
+func (a *Archive) AvatarURL(userID string) string {
+	return a.URL + "/avatars/" + userID + ".jpg"
+}
+
+// post returns the post with the given ID with default URLs filled in.
+func (a *Archive) post(id string) (Post, bool) {
+	post, ok := a.Posts[id]
+	if !ok {
+		return post, false
+	}
+	if post.VideoURL == "" {
+		post.VideoURL = a.VideoURL(id)
+	}
+	if post.ThumbnailURL == "" {
+		post.ThumbnailURL = a.ThumbnailURL(id)
+	}
+	if post.AvatarURL == "" {
+		post.AvatarURL = a.AvatarURL(post.UserIdStr)
+	}
+	return post, true
+}
+
+// Requests returns the number of requests made for path, eg
+// "/posts/b9KOOWX7HUx.json".
+func (a *Archive) Requests(path string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests[path]
+}
+
+// WriteDir lays out the archive's posts, profiles, vanities and videos in dir
+// like a mirror of archive.vine.co would be. Videos are written at the paths
+// of their URLs.
+func (a *Archive) WriteDir(dir string) error {
+	for id := range a.Posts {
+		post, _ := a.post(id)
+		err := writeJSONFile(filepath.Join(dir, "posts", id+".json"), post)
+		if err != nil {
+			return err
+		}
+	}
+	for id, profile := range a.Profiles {
+		err := writeJSONFile(filepath.Join(dir, "profiles", id+".json"), profile)
+		if err != nil {
+			return err
+		}
+	}
+	for name, userID := range a.Vanities {
+		err := writeJSONFile(filepath.Join(dir, "vanities", name+".json"), vanity(userID))
+		if err != nil {
+			return err
+		}
+	}
+	for id, video := range a.Videos {
+		err := writeFile(filepath.Join(dir, "videos", id+".mp4"), video)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NotModified returns the number of 304 Not Modified responses sent for path.
+func (a *Archive) NotModified(path string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.notModified[path]
+}
+
+// Fail makes the next n requests for path fail with the given status code.
+// If retryAfter isn't empty it's sent as the Retry-After header.
+func (a *Archive) Fail(path string, n, status int, retryAfter string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < n; i++ {
+		a.failures[path] = append(a.failures[path], failure{status, retryAfter})
+	}
+}
+
+func (a *Archive) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.requests[r.URL.Path]++
+	var fail *failure
+	if fs := a.failures[r.URL.Path]; len(fs) > 0 {
+		fail = &fs[0]
+		a.failures[r.URL.Path] = fs[1:]
+	}
+	a.mu.Unlock()
+
+	if fail != nil {
+		if fail.retryAfter != "" {
+			w.Header().Set("Retry-After", fail.retryAfter)
+		}
+		http.Error(w, http.StatusText(fail.status), fail.status)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/posts/") && strings.HasSuffix(path, ".json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/posts/"), ".json")
+		post, ok := a.post(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		a.writeJSON(w, r, post)
+	case strings.HasPrefix(path, "/profiles/") && strings.HasSuffix(path, ".json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/profiles/"), ".json")
+		profile, ok := a.Profiles[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		a.writeJSON(w, r, profile)
+	case strings.HasPrefix(path, "/vanities/") && strings.HasSuffix(path, ".json"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/vanities/"), ".json")
+		userID, ok := a.Vanities[strings.ToLower(name)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		a.writeJSON(w, r, vanity(userID))
+	case strings.HasPrefix(path, "/videos/") && strings.HasSuffix(path, ".mp4"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/videos/"), ".mp4")
+		serveFile(w, r, a.Videos, id, "video/mp4")
+	case strings.HasPrefix(path, "/thumbs/") && strings.HasSuffix(path, ".jpg"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/thumbs/"), ".jpg")
+		serveFile(w, r, a.Thumbs, id, "image/jpeg")
+	case strings.HasPrefix(path, "/avatars/") && strings.HasSuffix(path, ".jpg"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/avatars/"), ".jpg")
+		serveFile(w, r, a.Avatars, id, "image/jpeg")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveFile serves files[id], supporting range requests.
+// vanity is the body of a vanity name mapping.
+func vanity(userID int64) map[string]string {
+	return map[string]string{"userIdStr": strconv.FormatInt(userID, 10)}
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, files map[string][]byte, id, contentType string) {
+	b, ok := files[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, id, time.Time{}, bytes.NewReader(b))
+}
+
+// writeJSON serves v as JSON with an ETag, supporting conditional requests.
+func (a *Archive) writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha1.Sum(b)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		a.mu.Lock()
+		a.notModified[r.URL.Path]++
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func writeJSONFile(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFile(name, b)
+}
+
+func writeFile(name string, b []byte) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, b, 0666)
+}
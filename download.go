@@ -0,0 +1,327 @@
+package creeperkeeper
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DownloadOptions determines what DownloadVinesOptions downloads.
+type DownloadOptions struct {
+	// Force overwrites existing files. Otherwise files that already exist are
+	// skipped.
+	Force bool
+	// Thumbnails and Avatars download vines' thumbnail images and their
+	// uploaders' avatars in addition to the videos.
+	Thumbnails bool
+	Avatars    bool
+	// Probe checks videos with ffprobe after they're downloaded. Videos that
+	// fail are removed so they'll be downloaded again next time.
+	Probe bool
+}
+
+// DownloadVines downloads vines' videos to their VideoFilenames, which are
+// determined by Output, replacing any existing files.
+func DownloadVines(vines []Vine) error {
+	return DownloadVinesOptions(vines, DownloadOptions{Force: true})
+}
+
+// DownloadVinesOptions downloads vines' videos, and optionally their
+// thumbnails and uploaders' avatars, Jobs.Download vines at a time. The given
+// vines are updated with the videos' sizes and checksums and the paths of
+// images that were downloaded or already exist, so the vines' metadata should
+// be written afterward. Videos that already exist keep the checksums
+// recorded in their metadata files.
+func DownloadVinesOptions(vines []Vine, opts DownloadOptions) error {
+	return DownloadVinesContext(context.Background(), vines, opts)
+}
+
+// DownloadVinesContext is like DownloadVinesOptions but stops when ctx is
+// done. Files are only created once they've been completely downloaded;
+// partial downloads are kept with a .part extension and resumed by later
+// calls. Nothing is downloaded if two different vines have the same UUID. If
+// any vines fail, the error is a *BatchError that says which.
+func DownloadVinesContext(ctx context.Context, vines []Vine, opts DownloadOptions) error {
+	if err := checkIDs(vines); err != nil {
+		return err
+	}
+	avatars := avatarDownloads{m: map[string]*avatarDownload{}}
+	f := func(ctx context.Context, vine *Vine) (struct{}, error) {
+		if !opts.Force && FileExists(vine.VideoFilename()) {
+			// Hashing the video again would record any corruption since it
+			// was downloaded as its correct checksum.
+			KeepChecksum(vine)
+		} else if err := downloadVideo(ctx, vine, opts); err != nil {
+			return struct{}{}, err
+		}
+
+		// Vines are still usable without images, so just log failures.
+		if opts.Thumbnails && vine.ThumbnailURL != "" {
+			err := downloadFile(ctx, vine.ThumbnailURL, vine.ThumbnailFilename(), opts.Force)
+			if err != nil {
+				log.Printf("get thumbnail for %s: %s", vine.UUID, err)
+			} else {
+				vine.ThumbnailFile = vine.ThumbnailFilename()
+			}
+		}
+		if opts.Avatars && vine.AvatarURL != "" && vine.UploaderID != "" {
+			err := avatars.get(ctx, *vine, opts.Force)
+			if err != nil {
+				log.Printf("get avatar for %s: %s", vine.UploaderID, err)
+			} else {
+				vine.AvatarFile = vine.AvatarFilename()
+			}
+		}
+		return struct{}{}, nil
+	}
+
+	// Jobs are pointers into vines so the workers can update them. Repeated
+	// vines are only downloaded once, so two workers don't write the same
+	// .part file.
+	jobs, copyDupes := dedupeJobs(vines)
+	pool := poolOptions{
+		atOnce:  Jobs.Download,
+		stage:   "download",
+		jobName: func(i int) string { return jobs[i].UUID },
+	}
+	results := parallel(ctx, jobs, pool, f)
+	copyDupes()
+	return batchError(ctx, "", results)
+}
+
+// downloadVideo downloads a vine's video and records its checksum, removing
+// it if opts.Probe is true and it isn't playable.
+func downloadVideo(ctx context.Context, vine *Vine, opts DownloadOptions) error {
+	err := downloadFile(ctx, vine.URL, vine.VideoFilename(), opts.Force)
+	if err != nil {
+		log.Printf("get %.20q: %s", vine.Title, err)
+		return err
+	} else if Verbose {
+		log.Printf("got %q", vine.Title)
+	}
+	err = recordChecksum(ctx, vine, opts.Probe)
+	if err != nil {
+		if opts.Probe && ctx.Err() == nil {
+			os.Remove(vine.VideoFilename())
+		}
+		log.Printf("verify %.20q: %s", vine.Title, err)
+		return err
+	}
+	return nil
+}
+
+// avatarDownloads makes sure each user's avatar is only downloaded once, even
+// though many of their vines are downloaded concurrently.
+type avatarDownloads struct {
+	sync.Mutex
+	m map[string]*avatarDownload
+}
+
+type avatarDownload struct {
+	once sync.Once
+	err  error
+}
+
+func (a *avatarDownloads) get(ctx context.Context, vine Vine, force bool) error {
+	a.Lock()
+	d, ok := a.m[vine.UploaderID]
+	if !ok {
+		d = &avatarDownload{}
+		a.m[vine.UploaderID] = d
+	}
+	a.Unlock()
+	d.once.Do(func() {
+		d.err = downloadFile(ctx, vine.AvatarURL, vine.AvatarFilename(), force)
+	})
+	return d.err
+}
+
+// partExt is appended to the names of files that are being downloaded.
+const partExt = ".part"
+
+// downloadFile GETs url and writes the response body to filename. If force
+// is false and the file already exists nothing is done.
+//
+// The body is written to filename+".part", which is only renamed to filename
+// once it's complete. If a .part file is left by an earlier failure or
+// interruption, the download is resumed from where it left off using a range
+// request. Transfers that fail partway through are resumed the same way, up to
+// Retry.MaxAttempts times.
+func downloadFile(ctx context.Context, url, filename string, force bool) error {
+	if !force && FileExists(filename) {
+		return nil
+	}
+	part := filename + partExt
+	if force {
+		os.Remove(part)
+	}
+	err := mkdirFor(filename)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; attempt <= Retry.MaxAttempts || attempt == 1; attempt++ {
+		var done bool
+		done, err = downloadPart(ctx, url, part)
+		if done {
+			return os.Rename(part, filename)
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		if _, ok := err.(resumableError); !ok {
+			break
+		}
+		if Verbose {
+			log.Printf("%s: resuming", err)
+		}
+	}
+	return err
+}
+
+// resumableError is a failure partway through a transfer, which can be
+// resumed.
+type resumableError struct {
+	err error
+}
+
+func (e resumableError) Error() string {
+	return e.err.Error()
+}
+
+// downloadPart downloads url to part, appending to it if it already has some
+// data. done is true if part has the complete body.
+func downloadPart(ctx context.Context, url, part string) (done bool, err error) {
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := httpGet(ctx, url, header)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The server sent the whole body, either because we asked for it or
+		// because it doesn't support ranges.
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		start, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != offset {
+			os.Remove(part)
+			return false, resumableError{fmt.Errorf("download %s: unexpected Content-Range %q", url, resp.Header.Get("Content-Range"))}
+		}
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The .part file might already be complete.
+		_, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if ok && total == offset {
+			return true, nil
+		}
+		os.Remove(part)
+		return false, resumableError{fmt.Errorf("download %s: partial file doesn't match", url)}
+	default:
+		return false, fmt.Errorf("download %s: HTTP %d", url, resp.StatusCode)
+	}
+
+	f, err := os.OpenFile(part, flags, 0666)
+	if err != nil {
+		return false, err
+	}
+	size := resp.ContentLength
+	if size >= 0 && flags&os.O_APPEND != 0 {
+		size += offset
+	}
+	body := trackProgress(ctx, limitedReader{ctx, resp.Body, BandwidthLimiter}, url, offset, size)
+	n, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return false, resumableError{fmt.Errorf("download %s: %s", url, err)}
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return false, resumableError{fmt.Errorf("download %s: got %d bytes, want %d", url, n, resp.ContentLength)}
+	}
+	return true, nil
+}
+
+// parseContentRange parses Content-Range headers like "bytes 100-199/200" and
+// "bytes */200". start is -1 for the latter, and total is -1 if it's unknown.
+func parseContentRange(s string) (start, total int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, false
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(s, '/')
+	if slash < 0 {
+		return 0, 0, false
+	}
+	rng, size := s[:slash], s[slash+1:]
+	total = -1
+	if size != "*" {
+		var err error
+		total, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	if rng == "*" {
+		return -1, total, true
+	}
+	dash := strings.IndexByte(rng, '-')
+	if dash < 0 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(rng[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// download GETs url and writes the response body to w. Reading the body is
+// throttled by BandwidthLimiter.
+func download(ctx context.Context, url string, w io.Writer) error {
+	resp, err := httpGet(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: HTTP %d", url, resp.StatusCode)
+	}
+	body := trackProgress(ctx, limitedReader{ctx, resp.Body, BandwidthLimiter}, url, 0, resp.ContentLength)
+	_, err = io.Copy(w, body)
+	if err != nil {
+		return fmt.Errorf("download %s: %s", url, err)
+	}
+	return nil
+}
+
+// imageExt returns the file extension for an image URL, defaulting to .jpg.
+func imageExt(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ".jpg"
+	}
+	switch ext := strings.ToLower(path.Ext(u.Path)); ext {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return ext
+	}
+	return ".jpg"
+}
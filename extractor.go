@@ -0,0 +1,204 @@
+package creeperkeeper
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// An Extractor gets vine metadata for URLs from a particular source.
+type Extractor interface {
+	// Name identifies the extractor in error messages.
+	Name() string
+	// Match reports whether the extractor recognizes url.
+	Match(url string) bool
+	// Extract gets metadata for the vines referred to by url.
+	Extract(url string) ([]Vine, error)
+}
+
+// A ContextExtractor is an Extractor that can stop early when a context is
+// done. ExtractVinesContext uses ExtractContext instead of Extract for
+// extractors that implement it.
+type ContextExtractor interface {
+	Extractor
+	ExtractContext(ctx context.Context, url string) ([]Vine, error)
+}
+
+var extractors = struct {
+	sync.Mutex
+	list []Extractor
+}{}
+
+func init() {
+	RegisterExtractor(funcExtractor{
+		name:    "individual",
+		match:   isURLKind(PostURL),
+		extract: vineURLToVines,
+	})
+	RegisterExtractor(funcExtractor{
+		name:    "user",
+		match:   isURLKind(UserURL, VanityURL, LikesURL),
+		extract: userURLToVines,
+	})
+}
+
+// isURLKind returns a match function for URLs that ParseVineURL recognizes as
+// one of the given kinds.
+func isURLKind(kinds ...URLKind) func(string) bool {
+	return func(url string) bool {
+		u, err := ParseVineURL(url)
+		if err != nil {
+			return false
+		}
+		for _, k := range kinds {
+			if u.Kind == k {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RegisterExtractor makes an extractor available to ExtractVines. Extractors
+// are consulted in the order they're registered, so the built-in extractors
+// take precedence when more than one matches a URL.
+func RegisterExtractor(e Extractor) {
+	extractors.Lock()
+	defer extractors.Unlock()
+	extractors.list = append(extractors.list, e)
+}
+
+func registeredExtractors() []Extractor {
+	extractors.Lock()
+	defer extractors.Unlock()
+	list := make([]Extractor, len(extractors.list))
+	copy(list, extractors.list)
+	return list
+}
+
+// ExtractVines gets vine metadata related to a url for a single vine or a user
+// profile, in any of the forms ParseVineURL accepts. Requests are made as
+// necessary to get all of a user's posts. Likes weren't archived, so likes
+// URLs give an error.
+//
+// The first registered extractor that matches the url is used. If none match,
+// each extractor is tried in turn until one returns some vines. Vines that an
+// extractor doesn't give a UUID get one derived from their URL, and ones
+// without a URL are left out with an error.
+func ExtractVines(url string) (vines []Vine, err error) {
+	return ExtractVinesContext(context.Background(), url)
+}
+
+// ExtractVinesContext is like ExtractVines but stops making requests when ctx
+// is done.
+func ExtractVinesContext(ctx context.Context, url string) (vines []Vine, err error) {
+	vines, err = extractVines(ctx, url)
+	vines, idErr := assignIDs(vines)
+	if err == nil {
+		err = idErr
+	}
+	return vines, err
+}
+
+func extractVines(ctx context.Context, url string) (vines []Vine, err error) {
+	list := registeredExtractors()
+	for _, e := range list {
+		if e.Match(url) {
+			vines, err = extract(ctx, e, url)
+			if err != nil {
+				err = fmt.Errorf("%s: %s", e.Name(), err)
+			}
+			return vines, err
+		}
+	}
+
+	var errs []string
+	for _, e := range list {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		vines, err = extract(ctx, e, url)
+		if err != nil {
+			err = fmt.Errorf("%s: %s", e.Name(), err)
+			errs = append(errs, err.Error())
+		}
+		if len(vines) > 0 {
+			return vines, err
+		}
+	}
+	return nil, fmt.Errorf("vine extraction: %s", strings.Join(errs, "; "))
+}
+
+// ExtractAllVines extracts vines from several URLs concurrently. The vines
+// from each URL are returned separately, in the same order as urls. Failures
+// are logged, and the vines from the URLs that succeeded are still returned
+// along with a *BatchError. All the URLs share a limit of Jobs.Metadata
+// metadata requests at once.
+func ExtractAllVines(ctx context.Context, urls []string) ([][]Vine, error) {
+	ctx = withRequestSlots(ctx, Jobs.Metadata)
+	f := func(ctx context.Context, url string) ([]Vine, error) {
+		vines, err := ExtractVinesContext(ctx, url)
+		if err != nil {
+			err = fmt.Errorf("extract %s: %s", url, err)
+			log.Println(err)
+			return vines, err
+		}
+		if Verbose {
+			log.Printf("got metadata for %d vines from %s", len(vines), url)
+		}
+		return vines, nil
+	}
+	pool := poolOptions{
+		atOnce:  Jobs.Metadata,
+		stage:   "extract",
+		jobName: func(i int) string { return urls[i] },
+	}
+	results := parallel(ctx, urls, pool, f)
+	sources := make([][]Vine, len(urls))
+	for i, r := range results {
+		sources[i] = r.val
+	}
+	return sources, batchError(ctx, "", results)
+}
+
+// ReadURLList reads URLs from r, one per line. Blank lines and lines starting
+// with # are ignored.
+func ReadURLList(r io.Reader) ([]string, error) {
+	var urls []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, s.Err()
+}
+
+func extract(ctx context.Context, e Extractor, url string) ([]Vine, error) {
+	if ce, ok := e.(ContextExtractor); ok {
+		return ce.ExtractContext(ctx, url)
+	}
+	return e.Extract(url)
+}
+
+// funcExtractor adapts plain functions to the ContextExtractor interface.
+type funcExtractor struct {
+	name    string
+	match   func(url string) bool
+	extract func(ctx context.Context, url string) ([]Vine, error)
+}
+
+func (f funcExtractor) Name() string          { return f.name }
+func (f funcExtractor) Match(url string) bool { return f.match(url) }
+func (f funcExtractor) Extract(url string) ([]Vine, error) {
+	return f.extract(context.Background(), url)
+}
+func (f funcExtractor) ExtractContext(ctx context.Context, url string) ([]Vine, error) {
+	return f.extract(ctx, url)
+}
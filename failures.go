@@ -0,0 +1,145 @@
+package creeperkeeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A Failure is an item that a command couldn't process.
+type Failure struct {
+	// Stage and ID identify the job that failed, as in progress events: ID
+	// is a URL for the "extract" stage, a vine's short ID for "metadata",
+	// "download" and "import", and a video file for "scale" and "render".
+	// Steps that aren't split into jobs, like fetching a profile or writing
+	// metadata or a playlist, fail with stages such as "profile",
+	// "write-metadata" and "playlist", and the URL or playlist they were for
+	// as their ID.
+	Stage string
+	ID    string
+	Err   string
+	// Attempts is the number of runs that have tried the item and failed.
+	Attempts int
+	// Vine is the metadata of a vine that failed to download, so it can be
+	// retried without fetching its metadata again.
+	Vine *Vine `json:",omitempty"`
+}
+
+// A FailureReport records the items that failed during a run of a command,
+// along with the command line, so they can be retried.
+type FailureReport struct {
+	Command string
+	Args    []string
+	// Dir is the working directory the command was run in, which relative
+	// paths in Args are relative to.
+	Dir      string
+	Time     time.Time
+	Failures []Failure
+
+	mu sync.Mutex
+}
+
+// Record adds a failure for a JobFailed event and ignores other events, so it
+// can be called from Progress. If the same job fails more than once, only
+// the last error is kept.
+func (r *FailureReport) Record(e Event) {
+	if e.Kind != JobFailed {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Failures {
+		f := &r.Failures[i]
+		if f.Stage == e.Stage && f.ID == e.Job {
+			f.Err = e.Err
+			return
+		}
+	}
+	r.Failures = append(r.Failures, Failure{Stage: e.Stage, ID: e.Job, Err: e.Err, Attempts: 1})
+}
+
+// Failed reports whether the job with the given stage and ID failed.
+func (r *FailureReport) Failed(stage, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.Failures {
+		if f.Stage == stage && f.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CountAttempts adds the attempts from a previous report to the failures
+// that happened again.
+func (r *FailureReport) CountAttempts(prev *FailureReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Failures {
+		f := &r.Failures[i]
+		for _, p := range prev.Failures {
+			if p.Stage == f.Stage && p.ID == f.ID {
+				f.Attempts += p.Attempts
+				break
+			}
+		}
+	}
+}
+
+// ReadFailureReport reads a report written by FailureReport.Write.
+func ReadFailureReport(name string) (*FailureReport, error) {
+	r := &FailureReport{}
+	err := decodeFile(name, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write saves the report atomically.
+func (r *FailureReport) Write(name string) error {
+	r.mu.Lock()
+	b, err := json.MarshalIndent(r, "", "\t")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp_report")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// AttachVines adds the metadata of vines that failed to download to their
+// failures, so they can be retried without extracting them again.
+func (r *FailureReport) AttachVines(vines []Vine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.Failures {
+		f := &r.Failures[i]
+		if f.Stage != "download" {
+			continue
+		}
+		for _, v := range vines {
+			if v.UUID == f.ID {
+				v := v
+				f.Vine = &v
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package creeperkeeper
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// A Filter selects vines by their metadata. Zero fields don't filter
+// anything.
+type Filter struct {
+	// Vines created before Since or at or after Until are dropped.
+	Since time.Time
+	Until time.Time
+	// Vines with titles that don't match Match or do match Exclude are
+	// dropped.
+	Match   *regexp.Regexp
+	Exclude *regexp.Regexp
+	// Uploader is a username or user ID. Vines uploaded by anyone else, such
+	// as reposts on a user's profile, are dropped. Usernames are compared
+	// case-insensitively.
+	Uploader string
+	// Hashtag drops vines without this hashtag, which is compared
+	// case-insensitively and without the leading #.
+	Hashtag  string
+	MinLoops int64
+	MinLikes int64
+}
+
+// Keep reports whether v passes the filter.
+func (f Filter) Keep(v Vine) bool {
+	if !f.Since.IsZero() && v.Created.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !v.Created.Before(f.Until) {
+		return false
+	}
+	if f.Match != nil && !f.Match.MatchString(v.Title) {
+		return false
+	}
+	if f.Exclude != nil && f.Exclude.MatchString(v.Title) {
+		return false
+	}
+	if f.Uploader != "" && f.Uploader != v.UploaderID && !strings.EqualFold(f.Uploader, v.Uploader) {
+		return false
+	}
+	if f.Hashtag != "" && !hasHashtag(v, strings.TrimPrefix(f.Hashtag, "#")) {
+		return false
+	}
+	return v.Loops >= f.MinLoops && v.Likes >= f.MinLikes
+}
+
+func hasHashtag(v Vine, tag string) bool {
+	for _, h := range v.Hashtags {
+		if strings.EqualFold(h, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the vines that pass the filter, in the same order.
+func (f Filter) Apply(vines []Vine) []Vine {
+	kept := []Vine{}
+	for _, v := range vines {
+		if f.Keep(v) {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// LimitVines skips the first offset vines and returns at most limit of the
+// rest. A limit of 0 or less means no limit, and an offset less than 0 is
+// treated as 0.
+func LimitVines(vines []Vine, offset, limit int) []Vine {
+	return limitSlice(vines, offset, limit)
+}
+
+// limitSlice is LimitVines for any kind of item.
+func limitSlice[T any](items []T, offset, limit int) []T {
+	if offset > len(items) {
+		offset = len(items)
+	}
+	if offset > 0 {
+		items = items[offset:]
+	}
+	if limit > 0 && limit < len(items) {
+		items = items[:limit]
+	}
+	return items
+}
@@ -1,206 +1,134 @@
 package creeperkeeper
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net/http"
-	"os"
-	"regexp"
-	"sync"
+	"strings"
 	"time"
 )
 
 const vineDateFormat = "2006-01-02T15:04:05.999999"
 
-var fallbackUUIDCount = 0
-var uuidMutex = sync.Mutex{}
-
-type vineExtractor func(url string) (vines []Vine, err error)
-
-// DownloadVines downloads vines to files named after their shortIDs, eg
-// bnmHnwVILKD.mp4.
-func DownloadVines(vines []Vine) error {
-	f := func(i interface{}) (err error) {
-		vine := i.(Vine)
-		file, err := os.Create(vine.VideoFilename())
-		if err != nil {
-			return err
-		}
-		defer func() {
-			if cerr := file.Close(); err == nil && cerr != nil {
-				err = cerr
-			}
-		}()
-		err = vine.Download(file)
-		if err != nil {
-			log.Printf("get %.20q: %s", vine.Title, err)
-		} else if Verbose {
-			log.Printf("got %q", vine.Title)
-		}
-		return err
-	}
-
-	// Convert []Vine to []interface{}
-	jobs := make([]interface{}, len(vines))
-	for i, v := range vines {
-		jobs[i] = v
-	}
-
-	nerr := parallel(jobs, f, 4)
-	if nerr > 0 {
-		return fmt.Errorf("%d/%d failed", nerr, len(vines))
-	}
-	return nil
-}
-
-// ExtractVines gets vine metadata related to a url for a single vine, a user
-// profile, or a user's likes. API requests are made as necessary to get all of
-// a user's posts or likes.
-func ExtractVines(url string) (vines []Vine, err error) {
-	extractors := map[string]vineExtractor{
-		"individual": vineExtractor(vineURLToVines),
-		"user":       vineExtractor(userURLToVines),
-	}
-	errs := map[string]error{}
-	for name, extractor := range extractors {
-		vines, err = extractor(url)
-		if err != nil {
-			err = fmt.Errorf("%s: %s", name, err.Error())
-			errs[name] = err
-		}
-		if len(vines) > 0 {
-			return vines, err
-		}
+// vineURLToVines gets vine metadata for the vine referred to by the given URL.
+func vineURLToVines(ctx context.Context, url string) (vines []Vine, err error) {
+	u, err := ParseVineURL(url)
+	if err != nil {
+		return nil, err
 	}
-	s := "vine extraction: "
-	for name, err := range errs {
-		s += fmt.Sprintf("%s: %s", name, err.Error())
+	if u.Kind != PostURL {
+		return nil, fmt.Errorf("not a vine post url: %s", url)
 	}
-	return nil, errors.New(s)
-}
-
-// vineURLToVines gets vine metadata for the vine referred to by the given URL.
-func vineURLToVines(url string) (vines []Vine, err error) {
-	vineURLRE := regexp.MustCompile(`https?://(?:www\.)?vine\.co/(?:v|oembed)/([^?/]+)`)
-	m := vineURLRE.FindStringSubmatch(url)
-	if len(m) == 0 {
-		return nil, fmt.Errorf("vineURLToVines: unrecognized url: %s", url)
-	}
-	id := m[1]
-	vine, err := getVine(id)
+	vine, err := getVine(ctx, u.ID)
 	if err != nil {
 		return nil, err
 	}
 	return []Vine{vine}, nil
 }
 
-func getVine(id string) (Vine, error) {
+func getVine(ctx context.Context, id string) (Vine, error) {
 	var jv jsonVine
-	url := fmt.Sprintf("https://archive.vine.co/posts/%s.json", id)
-	err := deserialize(url, &jv)
+	url := fmt.Sprintf("%s/posts/%s.json", ArchiveURL, id)
+	err := deserialize(ctx, url, &jv)
 	if err != nil {
 		return Vine{}, fmt.Errorf("getVine %s: %s", id, err)
 	}
-	created, err := time.Parse(vineDateFormat, jv.Created)
+	vine, err := jv.vine(id)
 	if err != nil {
 		return Vine{}, fmt.Errorf("getVine %s: %s", id, err)
 	}
-	return Vine{
-		Title:      jv.Description,
-		Uploader:   jv.Username,
-		UploaderID: jv.UserIdStr,
-		URL:        jv.VideoURL,
-		UUID:       id,
-		Created:    created,
-	}, nil
+	if err := LearnedVanities.learn(vine); err != nil {
+		log.Printf("learn vanity name: %s", err)
+	}
+	return vine, nil
 }
 
-func userURLToVines(url string) ([]Vine, error) {
-	userID, err := userURLToUserID(url)
+func userURLToVines(ctx context.Context, url string) ([]Vine, error) {
+	userID, err := userURLToUserID(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("userURLToVines: %s", err)
 	}
-	var ju jsonUser
-	postsURL := fmt.Sprintf("https://archive.vine.co/profiles/%s.json", userID)
-	err = deserialize(postsURL, &ju)
+	ju, err := getProfile(ctx, userID)
 	if err != nil {
 		return nil, fmt.Errorf("userURLToVines: %s", err)
 	}
+	return getVines(ctx, ju.Posts, ju.AvatarURL)
+}
+
+func getProfile(ctx context.Context, userID string) (jsonUser, error) {
+	var ju jsonUser
+	url := fmt.Sprintf("%s/profiles/%s.json", ArchiveURL, userID)
+	err := deserialize(ctx, url, &ju)
+	return ju, err
+}
 
+// getVines gets metadata for several posts concurrently, Jobs.Metadata at a
+// time. The vines that were fetched are returned in the same order as ids,
+// along with a *BatchError if any failed. Vines without an avatar URL are
+// given avatarURL.
+func getVines(ctx context.Context, ids []string, avatarURL string) ([]Vine, error) {
 	if Verbose {
-		log.Printf("getting metadata for %d vines", len(ju.Posts))
+		log.Printf("getting metadata for %d vines", len(ids))
 	}
 
-	var vines []Vine
-	vineq := make(chan Vine)
-	wg := sync.WaitGroup{}
-	go func() {
-		wg.Add(1)
-		for vine := range vineq {
-			vines = append(vines, vine)
-		}
-		wg.Done()
-	}()
-	jobs := make([]interface{}, len(ju.Posts))
-	for i, v := range ju.Posts {
-		jobs[i] = v
-	}
-	f := func(i interface{}) error {
-		id := i.(string)
-		vine, err := getVine(id)
+	f := func(ctx context.Context, id string) (Vine, error) {
+		vine, err := getVine(ctx, id)
 		if err != nil {
-			return err
+			log.Println(err)
+			return Vine{}, err
 		}
-		vineq <- vine
-		return nil
+		if vine.AvatarURL == "" {
+			vine.AvatarURL = avatarURL
+		}
+		return vine, nil
 	}
-	nerr := parallel(jobs, f, 8)
-	close(vineq)
-	wg.Wait()
-	if nerr > 0 {
-		return vines, fmt.Errorf("get vine metadata: %d/%d failed", nerr, len(ju.Posts))
+	pool := poolOptions{
+		atOnce:  Jobs.Metadata,
+		stage:   "metadata",
+		jobName: func(i int) string { return ids[i] },
 	}
-	return vines, nil
+	results := parallel(ctx, ids, pool, f)
+	var vines []Vine
+	for _, r := range results {
+		if r.err == nil {
+			vines = append(vines, r.val)
+		}
+	}
+	return vines, batchError(ctx, "get vine metadata", results)
 }
 
-func userURLToUserID(url string) (string, error) {
-	userURLRE := regexp.MustCompile(`(?:https?://)?vine\.co/(u/)?([^/]+)/?(?:\?.*)?$`)
-	m := userURLRE.FindStringSubmatch(url)
-	if len(m) == 0 {
-		return "", fmt.Errorf("unrecognized vine user url: %q", url)
+func userURLToUserID(ctx context.Context, url string) (string, error) {
+	u, err := ParseVineURL(url)
+	if err != nil {
+		return "", err
 	}
-	isVanity := len(m[1]) == 0
-	if isVanity {
-		profileURL := fmt.Sprintf("https://vine.co/api/users/profiles/vanity/%s", m[2])
-		var jve jsonVanityEnvelope
-		err := deserialize(profileURL, &jve)
-		if err != nil {
-			return "", err
-		}
-		return fmt.Sprint(jve.Data.UserID), nil
-	} else {
-		return m[2], nil
+	switch u.Kind {
+	case UserURL:
+		return u.ID, nil
+	case VanityURL:
+		return resolveVanity(ctx, u.ID)
+	case LikesURL:
+		return "", fmt.Errorf("%s: likes weren't archived, only users' own posts", url)
 	}
+	return "", fmt.Errorf("not a vine user url: %s", url)
 }
 
 // deserialize GETs a JSON API endpoint, unwraps the enveloping object and
-// unmarshals the response.
-func deserialize(url string, d interface{}) error {
-	resp, err := http.Get(url)
+// unmarshals the response. Responses are cached in Cache. If ctx limits
+// metadata requests, it waits for a free slot first.
+func deserialize(ctx context.Context, url string, d interface{}) error {
+	release, err := acquireRequestSlot(ctx)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := Cache.fetch(ctx, url)
+	release()
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, body)
-	}
 	err = json.Unmarshal(body, &d)
 	if err != nil {
 		return fmt.Errorf("unrecognized json %s", err)
@@ -208,33 +136,231 @@ func deserialize(url string, d interface{}) error {
 	return nil
 }
 
-func vineURLToUUID(url string) string {
-	vineURLRE := regexp.MustCompile(`https://vine\.co/v/([a-zA-Z0-9]+)$`)
-	m := vineURLRE.FindStringSubmatch(url)
-	if len(m) == 0 {
-		uuidMutex.Lock()
-		defer uuidMutex.Unlock()
-		return fmt.Sprintf("fallbackID%d", fallbackUUIDCount)
+// fallbackID returns an ID for a vine that wasn't given one by its extractor.
+// The vine's short ID is used if its permalink or video URL is for a vine
+// page, and otherwise the ID is derived from a hash of the URL, so it's the
+// same every time the vine is extracted. Vines without either URL can't be
+// given an ID.
+func fallbackID(v Vine) (string, error) {
+	url := v.Permalink
+	if url == "" {
+		url = v.URL
+	}
+	if url == "" {
+		return "", fmt.Errorf("vine %.20q has no URL to derive an ID from", v.Title)
+	}
+	if u, err := ParseVineURL(url); err == nil && u.Kind == PostURL {
+		return u.ID, nil
+	}
+	sum := sha256.Sum256([]byte(url))
+	return "fallbackID" + hex.EncodeToString(sum[:8]), nil
+}
+
+// assignIDs gives vines without a UUID one from fallbackID. Vines that can't
+// be given one are left out of the returned vines.
+func assignIDs(vines []Vine) ([]Vine, error) {
+	kept := vines[:0]
+	var errs []string
+	for _, v := range vines {
+		if v.UUID == "" {
+			id, err := fallbackID(v)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			v.UUID = id
+		}
+		kept = append(kept, v)
+	}
+	if len(errs) > 0 {
+		return kept, fmt.Errorf("no ID: %s", strings.Join(errs, ", "))
+	}
+	return kept, nil
+}
+
+// checkIDs makes sure every vine has a UUID and that different vines don't
+// share a UUID or filenames, which would make them overwrite each other's
+// files. Vines with the same UUID and video URL are the same vine and don't
+// collide. Filenames are compared case-insensitively, since many filesystems
+// are. Vines are also checked against metadata already written to their
+// files, which must be for the same vine.
+func checkIDs(vines []Vine) error {
+	seen := make(map[string]string, len(vines))
+	files := make(map[string]string, len(vines))
+	var collisions []string
+	for _, v := range vines {
+		if v.UUID == "" {
+			return fmt.Errorf("vine with video %s has no ID", v.URL)
+		}
+		url, ok := seen[v.UUID]
+		if ok {
+			if url != v.URL {
+				collisions = append(collisions, fmt.Sprintf("%s (%s and %s)", v.UUID, url, v.URL))
+			}
+			continue
+		}
+		seen[v.UUID] = v.URL
+
+		base := v.basePath()
+		key := strings.ToLower(base)
+		if id, ok := files[key]; ok {
+			collisions = append(collisions, fmt.Sprintf("%s (%s and %s)", base, id, v.UUID))
+			continue
+		}
+		files[key] = v.UUID
+
+		if c := existingCollision(v); c != "" {
+			collisions = append(collisions, c)
+		}
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("ID collision: %s", strings.Join(collisions, ", "))
+	}
+	return nil
+}
+
+// existingCollision describes the collision between v and the metadata
+// already in its metadata file, if the file is for a different vine. It
+// returns "" if there's no file or it's for the same vine.
+func existingCollision(v Vine) string {
+	name := v.MetadataFilename()
+	old, err := ReadVineMetadata(name)
+	if err != nil {
+		// Missing or unreadable metadata will just be replaced.
+		return ""
 	}
-	return string(m[1])
+	switch {
+	case old.UUID != v.UUID:
+		return fmt.Sprintf("%s (%s on disk and %s)", name, old.UUID, v.UUID)
+	case old.URL != v.URL:
+		return fmt.Sprintf("%s (%s on disk and %s)", v.UUID, old.URL, v.URL)
+	}
+	return ""
+}
+
+// dedupeJobs returns pointers to the first vine with each UUID, so each
+// vine's files are only worked on once even if it's listed more than once.
+// copyDupes copies the results back to the repeats.
+func dedupeJobs(vines []Vine) (jobs []*Vine, copyDupes func()) {
+	first := make(map[string]int, len(vines))
+	for i := range vines {
+		if _, ok := first[vines[i].UUID]; ok {
+			continue
+		}
+		first[vines[i].UUID] = i
+		jobs = append(jobs, &vines[i])
+	}
+	copyDupes = func() {
+		for i := range vines {
+			if j := first[vines[i].UUID]; j != i {
+				vines[i] = vines[j]
+			}
+		}
+	}
+	return jobs, copyDupes
 }
 
 type jsonUser struct {
-	Posts []string
+	Posts     []string
+	AvatarURL string
 }
 
 type jsonVine struct {
-	Description string
-	Username    string
-	UserIdStr   string
-	VideoURL    string
-	Created     string
+	Description     string
+	Username        string
+	UserIdStr       string
+	VideoURL        string
+	Created         string
+	Loops           jsonCount
+	Likes           jsonCount
+	Reposts         jsonCount
+	Comments        jsonCount
+	VenueName       string
+	ThumbnailURL    string
+	AvatarURL       string
+	ExplicitContent jsonCount
+	PermalinkURL    string
+	Entities        []jsonEntity
 }
 
-// User API JSON structures
-type jsonVanityEnvelope struct {
-	Data jsonVanity
+// jsonEntity is a hashtag or mention in a post's description.
+type jsonEntity struct {
+	Type  string
+	ID    jsonID
+	Title string
 }
+
+// jsonCount is a count or flag that some archives encode as a float or a
+// bool instead of an integer.
+type jsonCount int64
+
+func (c *jsonCount) UnmarshalJSON(b []byte) error {
+	switch s := string(b); s {
+	case "null":
+		return nil
+	case "true":
+		*c = 1
+		return nil
+	case "false":
+		*c = 0
+		return nil
+	}
+	var f float64
+	err := json.Unmarshal(b, &f)
+	if err != nil {
+		return err
+	}
+	*c = jsonCount(f)
+	return nil
+}
+
+// jsonID is a numeric ID that may be quoted. IDs are too big to survive being
+// decoded as float64.
+type jsonID string
+
+func (id *jsonID) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	*id = jsonID(strings.Trim(string(b), `"`))
+	return nil
+}
+
+// vine converts an archived post to a Vine.
+func (jv jsonVine) vine(id string) (Vine, error) {
+	created, err := time.Parse(vineDateFormat, jv.Created)
+	if err != nil {
+		return Vine{}, err
+	}
+	vine := Vine{
+		Title:        jv.Description,
+		Uploader:     jv.Username,
+		UploaderID:   jv.UserIdStr,
+		URL:          jv.VideoURL,
+		UUID:         id,
+		Created:      created,
+		Loops:        int64(jv.Loops),
+		Likes:        int64(jv.Likes),
+		Reposts:      int64(jv.Reposts),
+		Comments:     int64(jv.Comments),
+		Venue:        jv.VenueName,
+		ThumbnailURL: jv.ThumbnailURL,
+		AvatarURL:    jv.AvatarURL,
+		Explicit:     jv.ExplicitContent != 0,
+		Permalink:    jv.PermalinkURL,
+	}
+	for _, e := range jv.Entities {
+		switch e.Type {
+		case "tag":
+			vine.Hashtags = append(vine.Hashtags, e.Title)
+		case "mention":
+			vine.Mentions = append(vine.Mentions, Mention{UserID: string(e.ID), Username: e.Title})
+		}
+	}
+	return vine, nil
+}
+
+// jsonVanity is an archived vanity name mapping.
 type jsonVanity struct {
-	UserID int64
+	UserIdStr string
 }
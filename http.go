@@ -0,0 +1,186 @@
+package creeperkeeper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ArchiveURL is the base URL for archived post and profile metadata.
+var ArchiveURL = "https://archive.vine.co"
+
+// statusError is returned for responses with unexpected status codes.
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// RetryPolicy determines how requests that fail in a way that might be
+// temporary are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a request is made,
+	// including the first. Values less than 1 are treated as 1.
+	MaxAttempts int
+	// The wait before retrying doubles after each attempt, starting at
+	// MinBackoff and capped at MaxBackoff. Waits are randomly shortened by up
+	// to half to keep concurrent requests from retrying in lockstep.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// Retry is the retry policy used for all HTTP requests.
+var Retry = RetryPolicy{
+	MaxAttempts: 4,
+	MinBackoff:  500 * time.Millisecond,
+	MaxBackoff:  30 * time.Second,
+}
+
+// backoff returns how long to wait after the given attempt, which starts at 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// httpGet GETs url, retrying according to Retry if the request fails due to a
+// transient network error or a status code indicating a transient problem.
+// Requests are throttled by RequestLimiter. header may be nil.
+func httpGet(ctx context.Context, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	for attempt := 1; ; attempt++ {
+		err := RequestLimiter.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := Client.Do(req)
+		if attempt >= Retry.MaxAttempts || !retryable(ctx, resp, err) {
+			return resp, err
+		}
+		wait := Retry.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				if after > Retry.MaxBackoff {
+					// The server wants us to wait longer than we're
+					// willing to.
+					return resp, nil
+				}
+				wait = after
+			}
+			// Drain the body so the connection can be reused.
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if Verbose {
+			reason := ""
+			if err != nil {
+				reason = err.Error()
+			} else {
+				reason = resp.Status
+			}
+			log.Printf("get %s: %s: retrying in %s", url, reason, wait)
+		}
+		err = sleep(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep pauses for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryable reports whether a request that resulted in resp and err is worth
+// retrying. Only GETs are made, so they're safe to repeat, but only network
+// errors that are likely to be temporary are retried, and not if the
+// request was cancelled.
+func retryable(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return transientError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// transientError reports whether a network error might not happen again:
+// timeouts, connections that were refused or reset, and responses that were
+// cut off. Errors like failed certificate checks, unknown hosts and bad URLs
+// are permanent.
+func transientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// retryAfter parses the Retry-After header of 429 and 503 responses, which
+// can be either a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
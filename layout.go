@@ -0,0 +1,173 @@
+package creeperkeeper
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultPattern names a vine's files after its UUID.
+const DefaultPattern = "{{.UUID}}"
+
+// maxNameLen is the maximum length in bytes of each element of a path
+// produced by a Layout. Most filesystems allow 255.
+const maxNameLen = 200
+
+// A Layout determines where vines' files are written. All of a vine's files
+// share a base path, which is the result of executing Pattern with the vine,
+// relative to Dir. The base is extended with .mp4, .json, .srt and so on for
+// each kind of file. Slashes written in the pattern separate directories,
+// while slashes in the vine's fields, eg a title like "AC/DC", are replaced
+// like other characters that are unsafe in filenames.
+type Layout struct {
+	Dir     string
+	Pattern *template.Template // If nil, DefaultPattern is used.
+}
+
+// Output is the layout used to name the files of vines that haven't been
+// read from metadata files. Vines read from metadata files keep using the
+// paths they were written to.
+var Output Layout
+
+// NewLayout parses a filename pattern, which is a text/template executed with
+// a Vine. The pattern is checked by executing it with an example vine.
+func NewLayout(dir, pattern string) (Layout, error) {
+	tmpl, err := template.New("filename").Parse(pattern)
+	if err != nil {
+		return Layout{}, err
+	}
+	l := Layout{Dir: dir, Pattern: tmpl}
+	example := Vine{
+		Title:      "Chicken.",
+		Uploader:   "Jack",
+		UploaderID: "76",
+		UUID:       "b9KOOWX7HUx",
+		Created:    time.Date(2013, 5, 19, 21, 12, 31, 0, time.UTC),
+	}
+	_, err = l.Base(example)
+	if err != nil {
+		return Layout{}, err
+	}
+	return l, nil
+}
+
+// Base returns the path shared by a vine's files, without an extension.
+func (l Layout) Base(v Vine) (string, error) {
+	name := v.UUID
+	if l.Pattern != nil {
+		b := &bytes.Buffer{}
+		err := l.Pattern.Execute(b, escapeSeparators(v))
+		if err != nil {
+			return "", err
+		}
+		name = b.String()
+	}
+	name = sanitizePath(name)
+	if name == "" {
+		return "", fmt.Errorf("filename pattern gives an empty name for %s", v.UUID)
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(name)), nil
+}
+
+// escapeSeparators returns a copy of v with slashes and backslashes in its
+// string fields replaced by underscores, so only slashes written in a
+// pattern separate directories.
+func escapeSeparators(v Vine) Vine {
+	esc := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' {
+				return '_'
+			}
+			return r
+		}, s)
+	}
+	for _, p := range []*string{&v.Title, &v.Uploader, &v.UploaderID, &v.URL, &v.UUID, &v.Venue, &v.ThumbnailURL, &v.AvatarURL, &v.Permalink, &v.ThumbnailFile, &v.AvatarFile, &v.SHA256} {
+		*p = esc(*p)
+	}
+	hashtags := make([]string, len(v.Hashtags))
+	for i, h := range v.Hashtags {
+		hashtags[i] = esc(h)
+	}
+	v.Hashtags = hashtags
+	mentions := make([]Mention, len(v.Mentions))
+	for i, m := range v.Mentions {
+		mentions[i] = Mention{UserID: esc(m.UserID), Username: esc(m.Username)}
+	}
+	v.Mentions = mentions
+	return v
+}
+
+// sanitizePath makes a slash-separated relative path safe to use on any
+// common filesystem. Characters that are reserved on Windows, control
+// characters, and backslashes are replaced by underscores, leading and
+// trailing spaces and dots are removed from each element, and elements are
+// truncated to maxNameLen bytes. Elements that are empty or consist only of
+// dots are dropped, so the path can't escape the directory it's joined to,
+// and an underscore is added to device names like CON, which Windows
+// reserves.
+func sanitizePath(p string) string {
+	var elems []string
+	for _, elem := range strings.Split(p, "/") {
+		elem = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) || strings.ContainsRune(`<>:"\|?*`, r) {
+				return '_'
+			}
+			return r
+		}, elem)
+		elem = truncate(elem, maxNameLen)
+		elem = strings.Trim(elem, " .")
+		if elem == "" {
+			continue
+		}
+		elems = append(elems, avoidReservedName(elem))
+	}
+	return path.Join(elems...)
+}
+
+// reservedNames are device names that can't be used as filenames on
+// Windows, even with an extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// avoidReservedName adds an underscore to a path element whose name, before
+// any extension, is reserved on Windows, eg "con.txt" becomes "con_.txt".
+// Since extensions are added to a layout's paths, the last element is
+// checked too.
+func avoidReservedName(elem string) string {
+	name, ext := elem, ""
+	if i := strings.Index(elem, "."); i >= 0 {
+		name, ext = elem[:i], elem[i:]
+	}
+	if !reservedNames[strings.ToUpper(strings.TrimRight(name, " "))] {
+		return elem
+	}
+	return name + "_" + ext
+}
+
+// truncate shortens s to at most n bytes without splitting a UTF-8 sequence.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// mkdirFor creates the directory that will contain file, if necessary.
+func mkdirFor(file string) error {
+	return os.MkdirAll(filepath.Dir(file), 0777)
+}
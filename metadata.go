@@ -0,0 +1,163 @@
+package creeperkeeper
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// MetadataVersion is the version of the metadata files written by
+// WriteVineMetadata. Files written before versions were recorded are version
+// 0.
+const MetadataVersion = 1
+
+// metadataFile is the format of metadata files.
+type metadataFile struct {
+	Version int
+	Vine
+}
+
+// metadataMigrations[v] upgrades the fields of a version v metadata file to
+// version v+1.
+var metadataMigrations = []func(fields map[string]json.RawMessage) error{
+	// Version 0 files have the same fields as version 1, which only adds
+	// the version itself. Fields added since then are zero.
+	0: func(fields map[string]json.RawMessage) error { return nil },
+}
+
+// decodeVineMetadata reads a metadata file of any version, migrating it to
+// the current one. version is the version it was in, and unknown lists the
+// fields that Vine doesn't have, eg ones written by a newer version of crkr,
+// which aren't in vine.
+func decodeVineMetadata(r io.Reader) (vine Vine, version int, unknown []string, err error) {
+	fields := map[string]json.RawMessage{}
+	err = json.NewDecoder(r).Decode(&fields)
+	if err != nil {
+		return vine, 0, nil, err
+	}
+	if raw, ok := fields["Version"]; ok {
+		err = json.Unmarshal(raw, &version)
+		if err != nil {
+			return vine, 0, nil, fmt.Errorf("version: %s", err)
+		}
+	}
+	if version < 0 || version > MetadataVersion {
+		return vine, version, nil, fmt.Errorf("unsupported metadata version %d, want at most %d", version, MetadataVersion)
+	}
+	for v := version; v < MetadataVersion; v++ {
+		err = metadataMigrations[v](fields)
+		if err != nil {
+			return vine, version, nil, fmt.Errorf("migrate from version %d: %s", v, err)
+		}
+	}
+	unknown = unknownMetadataFields(fields)
+	delete(fields, "Version")
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return vine, version, unknown, err
+	}
+	err = json.Unmarshal(b, &vine)
+	return vine, version, unknown, err
+}
+
+// metadataFileVersion returns the version of an existing metadata file, or 0
+// if it doesn't exist or can't be read.
+func metadataFileVersion(name string) int {
+	var f struct{ Version int }
+	if err := decodeFile(name, &f); err != nil {
+		return 0
+	}
+	return f.Version
+}
+
+// unknownMetadataFields returns the sorted names of fields that aren't in
+// metadataFile.
+func unknownMetadataFields(fields map[string]json.RawMessage) []string {
+	known := map[string]bool{"Version": true}
+	t := reflect.TypeOf(Vine{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		known[f.Name] = true
+	}
+	unknown := []string{}
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// MigrateVineMetadata rewrites a metadata file in the current format if it's
+// in an older one. migrated is true if it was rewritten. Files with unknown
+// fields aren't rewritten, since the fields would be lost, and are reported
+// as errors. If strict is true, files already in the current format are
+// also reported if they have unknown fields.
+func MigrateVineMetadata(filename string, strict bool) (migrated bool, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	vine, version, unknown, err := decodeVineMetadata(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	if len(unknown) > 0 && (strict || version != MetadataVersion) {
+		return false, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	if version == MetadataVersion {
+		return false, nil
+	}
+	vine.base = strings.TrimSuffix(filename, ".json")
+	err = WriteVineMetadata(vine)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// FindVineMetadata returns the vine metadata files in dir and its
+// subdirectories. Other JSON files, such as sync manifests, are skipped.
+func FindVineMetadata(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		ok, err := isVineMetadata(path)
+		if err != nil {
+			log.Printf("%s: %s", path, err)
+		} else if ok {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// isVineMetadata reports whether a JSON file looks like vine metadata, of
+// any version.
+func isVineMetadata(name string) (bool, error) {
+	var fields map[string]json.RawMessage
+	err := decodeFile(name, &fields)
+	if err != nil {
+		return false, err
+	}
+	_, hasUUID := fields["UUID"]
+	_, hasURL := fields["URL"]
+	return hasUUID && hasURL, nil
+}
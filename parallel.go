@@ -1,51 +1,207 @@
 package creeperkeeper
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
 	"sync"
 )
 
-// parallel runs jobs concurrently.
-func parallel(jobs []interface{}, f func(interface{}) error, atOnce int) (nerr int) {
-	nerrors := &syncCounter{}
+// Concurrency is how many jobs of each kind are run at once.
+type Concurrency struct {
+	// Download is the number of videos and images downloaded at once.
+	Download int
+	// Metadata is the number of metadata requests made at once. It's shared
+	// by all the URLs that ExtractAllVines extracts at once.
+	Metadata int
+	// Encode is the number of ffmpeg processes run at once to scale videos
+	// and render subtitles.
+	Encode int
+}
 
-	// Producer
-	jobq := make(chan interface{})
-	go func() {
-		for _, job := range jobs {
-			jobq <- job
-		}
-	}()
+// DefaultConcurrency is the initial value of Jobs.
+var DefaultConcurrency = Concurrency{
+	Download: 4,
+	Metadata: 8,
+	Encode:   runtime.NumCPU(),
+}
+
+// Jobs limits the concurrency of downloads, metadata requests and encoding.
+// Values less than 1 are treated as 1.
+var Jobs = DefaultConcurrency
+
+// requestSlotsKey is the context key for the semaphore that limits metadata
+// requests.
+type requestSlotsKey struct{}
+
+// withRequestSlots returns a context in which at most n metadata requests are
+// made at once, however many pools are making them. Values less than 1 are
+// treated as 1.
+func withRequestSlots(ctx context.Context, n int) context.Context {
+	if n < 1 {
+		n = 1
+	}
+	return context.WithValue(ctx, requestSlotsKey{}, make(chan struct{}, n))
+}
+
+// acquireRequestSlot waits for a free request slot if ctx limits requests,
+// and returns a function that frees it.
+func acquireRequestSlot(ctx context.Context) (release func(), err error) {
+	slots, _ := ctx.Value(requestSlotsKey{}).(chan struct{})
+	if slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// poolOptions controls how parallel runs jobs.
+type poolOptions struct {
+	// atOnce is the maximum number of jobs run at once. Values less than 1
+	// are treated as 1.
+	atOnce int
+	// failFast stops the pool after the first failure: the context given to
+	// running jobs is cancelled, and jobs that haven't started are skipped.
+	failFast bool
+	// If stage isn't empty, progress events are reported for the pool's
+	// jobs, which are identified by jobName.
+	stage   string
+	jobName func(i int) string
+}
+
+// result is the outcome of a job run by parallel.
+type result[R any] struct {
+	val R
+	err error
+}
+
+// errSkipped is the result of jobs that weren't started because an earlier
+// job failed and the pool was failing fast.
+var errSkipped = errors.New("skipped after an earlier failure")
+
+// parallel calls f for each job concurrently and returns the results in the
+// same order as jobs. Once ctx is done, jobs that haven't been started are
+// skipped, with ctx's error as their result. The context given to f
+// attributes progress to the job.
+func parallel[J, R any](ctx context.Context, jobs []J, opts poolOptions, f func(ctx context.Context, job J) (R, error)) []result[R] {
+	results := make([]result[R], len(jobs))
+	poolCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	atOnce := opts.atOnce
+	if atOnce < 1 {
+		atOnce = 1
+	}
+	if atOnce > len(jobs) {
+		atOnce = len(jobs)
+	}
+	if opts.stage != "" {
+		report(Event{Kind: StageStarted, Stage: opts.stage, Total: len(jobs)})
+	}
 
-	// Consumers
+	indexes := make(chan int)
 	wg := &sync.WaitGroup{}
-	wg.Add(len(jobs))
-	for i := 0; i < atOnce; i++ {
+	wg.Add(atOnce)
+	for w := 0; w < atOnce; w++ {
 		go func() {
-			for job := range jobq {
-				err := f(job)
-				if err != nil {
-					log.Println(err)
-					nerrors.Add(1)
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = runJob(ctx, poolCtx, opts, i, jobs[i], f)
+				if results[i].err != nil && opts.failFast {
+					cancel()
 				}
-				wg.Done()
 			}
 		}()
 	}
+	for i := range jobs {
+		indexes <- i
+	}
+	close(indexes)
 	wg.Wait()
-	close(jobq)
-	return nerrors.val
+	if opts.stage != "" {
+		report(Event{Kind: StageFinished, Stage: opts.stage, Total: len(jobs)})
+	}
+	return results
 }
 
-type syncCounter struct {
-	val  int
-	lock sync.Mutex
+// runJob runs the i'th job for parallel, unless ctx or poolCtx is done.
+func runJob[J, R any](ctx, poolCtx context.Context, opts poolOptions, i int, job J, f func(context.Context, J) (R, error)) result[R] {
+	var r result[R]
+	if err := ctx.Err(); err != nil {
+		r.err = err
+	} else if poolCtx.Err() != nil {
+		r.err = errSkipped
+	}
+	if opts.stage == "" {
+		if r.err == nil {
+			r.val, r.err = f(poolCtx, job)
+		}
+		return r
+	}
+
+	name := strconv.Itoa(i)
+	if opts.jobName != nil {
+		name = opts.jobName(i)
+	}
+	if r.err == nil {
+		report(Event{Kind: JobStarted, Stage: opts.stage, Job: name})
+		r.val, r.err = f(withJob(poolCtx, opts.stage, name), job)
+	}
+	e := Event{Kind: JobFinished, Stage: opts.stage, Job: name}
+	if r.err != nil {
+		e.Kind, e.Err = JobFailed, r.err.Error()
+	}
+	report(e)
+	return r
 }
 
-func (s *syncCounter) Add(n int) int {
-	s.lock.Lock()
-	s.val += n
-	cur := s.val
-	s.lock.Unlock()
-	return cur
+// A BatchError is returned by functions that work on several items when some
+// of them fail. Failures are logged as they happen, so the message only says
+// how many there were.
+type BatchError struct {
+	// Op describes the operation, eg "render subtitles". It may be empty.
+	Op string
+	// Errs holds the error for each item that failed, keyed by the item's
+	// index in the input. Items that were skipped because the operation was
+	// interrupted are included.
+	Errs  map[int]error
+	Total int
+	// Err is the context's error if the operation was interrupted.
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	msg := fmt.Sprintf("%d/%d failed", len(e.Errs), e.Total)
+	if e.Op != "" {
+		msg = e.Op + ": " + msg
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// batchError returns a *BatchError for the jobs that failed, or nil if none
+// did.
+func batchError[R any](ctx context.Context, op string, results []result[R]) error {
+	errs := map[int]error{}
+	for i, r := range results {
+		if r.err != nil {
+			errs[i] = r.err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &BatchError{Op: op, Errs: errs, Total: len(results), Err: ctx.Err()}
 }
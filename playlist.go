@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -23,6 +25,76 @@ func ReadM3U(r io.Reader) (files []string, err error) {
 	return files, s.Err()
 }
 
+// ReadM3UFile returns the list of filenames in an M3U playlist file. Relative
+// paths in the playlist are relative to its directory, so they're joined to
+// it.
+func ReadM3UFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	files, err := ReadM3U(f)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(name)
+	for i, file := range files {
+		files[i] = resolvePlaylistPath(dir, file)
+	}
+	return files, nil
+}
+
+// WriteM3UFile writes an extended M3U playlist file. Paths in the playlist
+// are relative to its directory.
+func WriteM3UFile(name string, vines []Vine) (err error) {
+	dir := filepath.Dir(name)
+	b := &bytes.Buffer{}
+	fmt.Fprintln(b, "#EXTM3U")
+	for _, vine := range vines {
+		file, err := playlistPath(dir, vine.VideoFilename())
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(b, vine.m3uEntry(file))
+	}
+	return ioutil.WriteFile(name, b.Bytes(), 0666)
+}
+
+// playlistPath returns file relative to dir, the directory of a playlist,
+// with forward slashes.
+func playlistPath(dir, file string) (string, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absDir, absFile)
+	if err != nil {
+		// Eg, they're on different drives.
+		return filepath.ToSlash(absFile), nil
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// slashPath cleans a path and gives it forward slashes, so paths from
+// playlists and from the filesystem can be compared.
+func slashPath(p string) string {
+	return filepath.ToSlash(filepath.Clean(filepath.FromSlash(p)))
+}
+
+// resolvePlaylistPath is the inverse of playlistPath.
+func resolvePlaylistPath(dir, file string) string {
+	file = filepath.FromSlash(file)
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
 func WriteM3U(w io.Writer, vines []Vine) error {
 	_, err := fmt.Fprintln(w, "#EXTM3U")
 	if err != nil {
@@ -62,6 +134,84 @@ func HardSubM3U(w io.Writer, r io.Reader) error {
 	return nil
 }
 
+// UpdateM3U copies the M3U playlist r to w and adds entries for vines that
+// aren't already in it, at the start if prepend is true and the end
+// otherwise. Existing entries are left in the same order.
+func UpdateM3U(w io.Writer, r io.Reader, vines []Vine, prepend bool) error {
+	var lines []string
+	present := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "#EXTM3U" {
+			continue
+		}
+		if line != "" && !strings.HasPrefix(line, "#") {
+			present[slashPath(line)] = true
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	var added []string
+	for _, vine := range vines {
+		file := slashPath(vine.VideoFilename())
+		if present[file] {
+			continue
+		}
+		present[file] = true
+		added = append(added, vine.M3UEntry())
+	}
+	if prepend {
+		lines = append(added, lines...)
+	} else {
+		lines = append(lines, added...)
+	}
+
+	b := &bytes.Buffer{}
+	fmt.Fprintln(b, "#EXTM3U")
+	for _, line := range lines {
+		fmt.Fprintln(b, line)
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// HardSubM3UFile is like HardSubM3U but for playlist files, which may be in
+// different directories.
+func HardSubM3UFile(out, in string) error {
+	inDir, outDir := filepath.Dir(in), filepath.Dir(out)
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := &bytes.Buffer{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.HasPrefix(line, "#") || line == "" {
+			fmt.Fprintln(b, line)
+			continue
+		}
+		video := resolvePlaylistPath(inDir, line)
+		if subbed := SubtitledVideoFilename(video); FileExists(subbed) {
+			video = subbed
+		}
+		rel, err := playlistPath(outDir, video)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(b, rel)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(out, b.Bytes(), 0666)
+}
+
 func FileExists(name string) bool {
 	_, err := os.Stat(name)
 	if os.IsNotExist(err) {
@@ -74,12 +224,17 @@ func FileExists(name string) bool {
 }
 
 func ReadMetadataForPlaylist(playlist string) ([]Vine, error) {
-	f, err := os.Open(playlist)
+	metaFiles, err := PlaylistMetadataFiles(playlist)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	videoFiles, err := ReadM3U(f)
+	return ReadAllVineMetadata(metaFiles)
+}
+
+// PlaylistMetadataFiles returns the names of the metadata files for the
+// videos in a playlist.
+func PlaylistMetadataFiles(playlist string) ([]string, error) {
+	videoFiles, err := ReadM3UFile(playlist)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +242,7 @@ func ReadMetadataForPlaylist(playlist string) ([]Vine, error) {
 	for i, file := range videoFiles {
 		metaFiles[i] = metadataFilename(file)
 	}
-	return ReadAllVineMetadata(metaFiles)
+	return metaFiles, nil
 }
 
 func metadataFilename(videoFile string) string {
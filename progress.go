@@ -0,0 +1,165 @@
+package creeperkeeper
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EventKind says what an Event reports.
+type EventKind string
+
+const (
+	// StageStarted and StageFinished bracket a batch of jobs, such as
+	// downloading a playlist's videos. Total is the number of jobs.
+	StageStarted  EventKind = "stage_started"
+	StageFinished EventKind = "stage_finished"
+	// Each job in a stage is started and then either finishes or fails. Jobs
+	// that are skipped because the stage was interrupted fail without
+	// starting. Err says why a job failed.
+	JobStarted  EventKind = "job_started"
+	JobFinished EventKind = "job_finished"
+	JobFailed   EventKind = "job_failed"
+	// Transfer reports how many Bytes of URL have been downloaded, out of
+	// Size if it's known.
+	Transfer EventKind = "transfer"
+	// Encode reports how far ffmpeg is through a video, in Percent.
+	Encode EventKind = "encode"
+)
+
+// An Event reports the progress of a long-running operation. Transfer and
+// Encode events that happen as part of a job have its Stage and Job.
+type Event struct {
+	Time time.Time
+	Kind EventKind
+	// Stage is the kind of job: "extract", "metadata", "download", "scale",
+	// or "render".
+	Stage string `json:",omitempty"`
+	// Job identifies a job within its stage, eg a vine's UUID, a URL, or a
+	// video file.
+	Job     string  `json:",omitempty"`
+	Total   int     `json:",omitempty"`
+	URL     string  `json:",omitempty"`
+	Bytes   int64   `json:",omitempty"`
+	Size    int64   `json:",omitempty"`
+	Percent float64 `json:",omitempty"`
+	Err     string  `json:",omitempty"`
+}
+
+// Progress, if not nil, is called with progress events. It's called from
+// many goroutines at once, so it needs to be safe for concurrent use, and it
+// should return quickly.
+var Progress func(Event)
+
+// reportInterval is the minimum time between Transfer or Encode events for
+// a single job.
+const reportInterval = 200 * time.Millisecond
+
+func report(e Event) {
+	if Progress == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	Progress(e)
+}
+
+type jobKey struct{}
+
+type jobInfo struct {
+	stage, job string
+}
+
+// withJob returns a context that says which job work done with it is for, so
+// the progress of that work can be attributed to the job.
+func withJob(ctx context.Context, stage, job string) context.Context {
+	return context.WithValue(ctx, jobKey{}, jobInfo{stage, job})
+}
+
+// reportJob reports an event for the job ctx is for, if any.
+func reportJob(ctx context.Context, e Event) {
+	if Progress == nil {
+		return
+	}
+	if info, ok := ctx.Value(jobKey{}).(jobInfo); ok {
+		e.Stage, e.Job = info.stage, info.job
+	}
+	report(e)
+}
+
+// progressReader reports how much of a download has been read.
+type progressReader struct {
+	ctx  context.Context
+	r    io.Reader
+	url  string
+	n    int64
+	size int64
+	last time.Time
+}
+
+// trackProgress wraps the body of a response for url so reads are reported
+// as Transfer events. offset is the amount that was already downloaded, and
+// size the total, or a negative number if it isn't known.
+func trackProgress(ctx context.Context, r io.Reader, url string, offset, size int64) io.Reader {
+	if Progress == nil {
+		return r
+	}
+	if size < 0 {
+		size = 0
+	}
+	return &progressReader{ctx: ctx, r: r, url: url, n: offset, size: size}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if err != nil || time.Since(p.last) >= reportInterval {
+		p.last = time.Now()
+		reportJob(p.ctx, Event{Kind: Transfer, URL: p.url, Bytes: p.n, Size: p.size})
+	}
+	return n, err
+}
+
+// ffmpegProgress parses the key=value lines that ffmpeg writes with
+// "-progress pipe:1" and reports them as Encode events.
+type ffmpegProgress struct {
+	ctx      context.Context
+	duration time.Duration
+	buf      []byte
+	last     time.Time
+}
+
+func (p *ffmpegProgress) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.line(string(bytes.TrimSpace(p.buf[:i])))
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (p *ffmpegProgress) line(line string) {
+	switch {
+	case line == "progress=end":
+		reportJob(p.ctx, Event{Kind: Encode, Percent: 100})
+	case strings.HasPrefix(line, "out_time_us="):
+		us, err := strconv.ParseInt(strings.TrimPrefix(line, "out_time_us="), 10, 64)
+		if err != nil || us < 0 || time.Since(p.last) < reportInterval {
+			return
+		}
+		p.last = time.Now()
+		pct := 100 * float64(time.Duration(us)*time.Microsecond) / float64(p.duration)
+		if pct > 100 {
+			pct = 100
+		}
+		reportJob(p.ctx, Event{Kind: Encode, Percent: pct})
+	}
+}
@@ -0,0 +1,95 @@
+package creeperkeeper
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RequestLimiter limits the rate of all HTTP requests, including retries. It's
+// nil, meaning unlimited, by default.
+var RequestLimiter *RateLimiter
+
+// BandwidthLimiter limits the rate at which video bodies are read, in bytes
+// per second. It's nil, meaning unlimited, by default.
+var BandwidthLimiter *RateLimiter
+
+// A RateLimiter is a token bucket. Tokens are added at a constant rate up to a
+// maximum of burst, and waiting for tokens removes them. It's safe for
+// concurrent use, and a nil *RateLimiter never blocks.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter that allows rate events per second on
+// average and up to burst events at once. The bucket starts full. If rate
+// isn't positive there's no limit, and nil is returned.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if !(rate > 0) {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until an event is allowed or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	return l.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n events are allowed or ctx is done. n may exceed the
+// burst size, in which case the limiter goes into debt and later callers wait
+// longer.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return ctx.Err()
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleep(ctx, wait)
+}
+
+// limitedReader throttles reads from r using a RateLimiter that counts bytes.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (lr limitedReader) Read(p []byte) (int, error) {
+	if lr.limiter == nil {
+		return lr.r.Read(p)
+	}
+	// Keep reads small enough that the transfer is smooth.
+	if max := int(lr.limiter.burst); len(p) > max {
+		p = p[:max]
+	}
+	n, err := lr.r.Read(p)
+	if werr := lr.limiter.WaitN(lr.ctx, n); err == nil {
+		err = werr
+	}
+	return n, err
+}
@@ -1,6 +1,7 @@
 package creeperkeeper
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,43 +10,54 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"runtime"
 	"strconv"
 )
 
 var widthRE = regexp.MustCompile(`streams\.stream\.\d+\.width=(\d+)`)
 var heightRE = regexp.MustCompile(`streams\.stream\.\d+\.height=(\d+)`)
 
-// ScaleAll normalizes all videos to 720x720.
+// ScaleAll normalizes all videos to 720x720, running Jobs.Encode ffmpeg
+// processes at once.
 func ScaleAll(files []string) error {
-	jobs, err := NeedScaling(files)
-	if err != nil {
-		return err
-	}
-	f := func(i interface{}) error {
-		file := i.(string)
-		err := scale(file)
+	return ScaleAllContext(context.Background(), files)
+}
+
+// ScaleAllContext is like ScaleAll but stops when ctx is done. Videos are
+// replaced atomically, so they're never left partially scaled. If any videos
+// can't be checked or scaled, the error is a *BatchError that says which.
+func ScaleAllContext(ctx context.Context, files []string) error {
+	f := func(ctx context.Context, file string) (struct{}, error) {
+		w, h, err := videoDimensions(ctx, file)
+		if err == nil && (w != 720 || h != 720) {
+			err = scale(ctx, file)
+		}
 		if err != nil {
 			log.Printf("scale %s: %s", file, err)
 		}
-		return err
+		return struct{}{}, err
 	}
-	interfaces := make([]interface{}, len(jobs))
-	for i, job := range jobs {
-		interfaces[i] = job
+	pool := poolOptions{
+		atOnce:  Jobs.Encode,
+		stage:   "scale",
+		jobName: func(i int) string { return files[i] },
 	}
-	nerr := parallel(interfaces, f, runtime.NumCPU())
-	if nerr != 0 {
-		return fmt.Errorf("%d/%d failed", nerr, len(jobs))
-	}
-	return nil
+	results := parallel(ctx, files, pool, f)
+	return batchError(ctx, "scale", results)
 }
 
+// NeedScaling returns the videos that aren't 720x720.
 func NeedScaling(files []string) ([]string, error) {
+	return needScaling(context.Background(), files)
+}
+
+func needScaling(ctx context.Context, files []string) ([]string, error) {
 	need := []string{}
 	nerr := 0
 	for _, file := range files {
-		w, h, err := videoDimensions(file)
+		if ctx.Err() != nil {
+			return need, ctx.Err()
+		}
+		w, h, err := videoDimensions(ctx, file)
 		if err != nil {
 			nerr++
 			log.Printf("get dimensions for %s: %s", file, err)
@@ -62,8 +74,9 @@ func NeedScaling(files []string) ([]string, error) {
 	return need, err
 }
 
-func videoDimensions(file string) (width int, height int, err error) {
-	cmd := exec.Command(
+func videoDimensions(ctx context.Context, file string) (width int, height int, err error) {
+	cmd := exec.CommandContext(
+		ctx,
 		"ffprobe",
 		"-v", "warning",
 		"-show_streams",
@@ -95,7 +108,7 @@ func videoDimensions(file string) (width int, height int, err error) {
 
 // Scale a video to standard dimensions (720x720). Some vines are only
 // available at 480x480.
-func scale(file string) error {
+func scale(ctx context.Context, file string) error {
 	dir, err := ioutil.TempDir("", "crkr_scale")
 	if err != nil {
 		return err
@@ -106,20 +119,43 @@ func scale(file string) error {
 		}
 	}()
 	scaled := filepath.Join(dir, "scaled.mp4")
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"ffmpeg",
 		"-v", "warning",
 		"-i", file,
 		"-vf", "scale=720:720",
 		scaled)
-	_, err = runCmd(cmd)
+	err = runFFmpeg(ctx, cmd, file)
 	if err != nil {
 		return err
 	}
 	return moveFile(file, scaled)
 }
 
-func moveFile(dst, src string) (err error) {
+// moveFile replaces dst with src atomically. If they're on different
+// filesystems src is first copied to a temporary file next to dst.
+func moveFile(dst, src string) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".crkr_move")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	err = copyFile(tmp.Name(), src)
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+func copyFile(dst, src string) (err error) {
 	dstFile, err := os.Create(dst)
 	if err != nil {
 		return err
@@ -133,11 +169,7 @@ func moveFile(dst, src string) (err error) {
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 	_, err = io.Copy(dstFile, srcFile)
-	if err != nil {
-		srcFile.Close()
-		return err
-	}
-	srcFile.Close()
-	return os.Remove(src)
+	return err
 }
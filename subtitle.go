@@ -2,6 +2,7 @@ package creeperkeeper
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -49,7 +50,16 @@ func WriteSubtitles(vines []Vine, t time.Duration, tmpl *template.Template, plai
 	return nil
 }
 
+// RenderAllSubtitles renders subtitles onto videos, running Jobs.Encode ffmpeg
+// processes at once. See RenderSubtitles.
 func RenderAllSubtitles(filenames []string, fontName string, fontSize int) error {
+	return RenderAllSubtitlesContext(context.Background(), filenames, fontName, fontSize)
+}
+
+// RenderAllSubtitlesContext is like RenderAllSubtitles but stops when ctx is
+// done, killing any running ffmpeg processes and removing their partial
+// output.
+func RenderAllSubtitlesContext(ctx context.Context, filenames []string, fontName string, fontSize int) error {
 	// A proactive check to avoid getting an error for every video.
 	_, err := exec.LookPath("ffmpeg")
 	if err != nil {
@@ -63,49 +73,87 @@ func RenderAllSubtitles(filenames []string, fontName string, fontSize int) error
 		}
 	}
 
-	f := func(i interface{}) error {
-		video := i.(string)
+	f := func(ctx context.Context, video string) (struct{}, error) {
 		subbed := SubtitledVideoFilename(video)
-		return RenderSubtitles(subbed, video, fontName, fontSize)
+		err := RenderSubtitlesContext(ctx, subbed, video, fontName, fontSize)
+		if err != nil {
+			log.Printf("render subtitles for %s: %s", video, err)
+		}
+		return struct{}{}, err
 	}
-
-	// Convert []string to []interface{}
-	jobs := make([]interface{}, len(filenames))
-	for i, f := range filenames {
-		jobs[i] = f
+	pool := poolOptions{
+		atOnce:  Jobs.Encode,
+		stage:   "render",
+		jobName: func(i int) string { return filenames[i] },
 	}
-
-	nerr := parallel(jobs, f, runtime.NumCPU())
-	if nerr > 0 {
-		return fmt.Errorf("render subtitles: %d/%d failed", nerr, len(filenames))
-	}
-	return nil
+	results := parallel(ctx, filenames, pool, f)
+	return batchError(ctx, "render subtitles", results)
 }
 
 // RenderSubtitles overlays subtitles in ${videoFile%.mp4}.srt on file to
 // produce ${videoFile%.mp4}.sub.mp4
 func RenderSubtitles(outFile, videoFile, fontName string, fontSize int) error {
+	return RenderSubtitlesContext(context.Background(), outFile, videoFile, fontName, fontSize)
+}
+
+// RenderSubtitlesContext is like RenderSubtitles but kills ffmpeg when ctx is
+// done. outFile is removed if rendering fails.
+func RenderSubtitlesContext(ctx context.Context, outFile, videoFile, fontName string, fontSize int) error {
 	basename := strings.TrimSuffix(videoFile, ".mp4")
 	subtitles := basename + ".srt"
-	subtitledVideo := SubtitledVideoFilename(videoFile)
-	style := fmt.Sprintf(
-		"subtitles=f=%s:force_style='FontName=%s,Fontsize=%d'",
-		subtitles, fontName, fontSize)
-	cmd := exec.Command(
+	cmd := exec.CommandContext(
+		ctx,
 		"ffmpeg",
 		"-y",
 		"-v", "warning",
 		"-i", videoFile,
-		"-vf", style,
-		subtitledVideo)
+		"-vf", subtitlesFilter(subtitles, fontName, fontSize),
+		outFile)
 	err := configureFontConfig(cmd)
 	if err != nil {
 		return err
 	}
-	_, err = runCmd(cmd)
+	err = runFFmpeg(ctx, cmd, videoFile)
+	if err != nil {
+		os.Remove(outFile)
+	}
 	return err
 }
 
+// subtitlesFilter returns an ffmpeg filtergraph that renders the subtitles in
+// file. Filenames from layouts can contain characters that are special in
+// filtergraphs, so they're escaped.
+func subtitlesFilter(file, fontName string, fontSize int) string {
+	style := fmt.Sprintf("FontName=%s,Fontsize=%d", fontName, fontSize)
+	return escapeFilter(fmt.Sprintf("subtitles=f=%s:force_style=%s", escapeFilterOption(file), escapeFilterOption(style)))
+}
+
+// escapeFilterOption escapes an option value in an ffmpeg filter's arguments,
+// eg a filename, which may contain any of the characters the filter syntax
+// uses.
+func escapeFilterOption(s string) string {
+	return backslashEscape(s, `\':`)
+}
+
+// escapeFilter escapes a filter and its arguments for use in an ffmpeg
+// filtergraph, eg as the argument to -vf.
+func escapeFilter(s string) string {
+	return backslashEscape(s, `\'[],;`)
+}
+
+// backslashEscape puts a backslash before each of the special characters in
+// s.
+func backslashEscape(s, special string) string {
+	b := &bytes.Buffer{}
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 func removeEmojiVariationSelectors(s string) string {
 	b := &bytes.Buffer{}
 	for len(s) > 0 {
@@ -0,0 +1,127 @@
+package creeperkeeper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ManifestFilename is the name of the manifest in a synced directory.
+const ManifestFilename = "crkr-manifest.json"
+
+// A Manifest records which of a user's posts have been synced to a directory,
+// so later syncs only need to get metadata for new posts.
+type Manifest struct {
+	URL    string
+	UserID string
+	// Posts are the IDs of posts that have been synced, sorted.
+	Posts []string
+	// Gone are the IDs of synced posts that are no longer in the user's
+	// profile, sorted.
+	Gone   []string
+	Synced time.Time
+}
+
+// ReadManifest reads a manifest file. If it doesn't exist the error satisfies
+// os.IsNotExist.
+func ReadManifest(name string) (*Manifest, error) {
+	m := &Manifest{}
+	err := decodeFile(name, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write writes the manifest to a file, replacing it atomically.
+func (m *Manifest) Write(name string) error {
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp_manifest")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// A SyncPlan describes how a synced directory differs from a user's profile.
+type SyncPlan struct {
+	// New has metadata for posts that haven't been synced yet.
+	New []Vine
+	// Gone are the IDs of synced posts that are no longer in the profile.
+	Gone []string
+}
+
+// Plan gets the profile for the manifest's URL and compares it to the posts
+// that have already been synced. Metadata is only fetched for new posts. If
+// some of it can't be fetched, the vines that could be are returned along with
+// an error.
+func (m *Manifest) Plan(ctx context.Context) (SyncPlan, error) {
+	var plan SyncPlan
+	userID, err := userURLToUserID(ctx, m.URL)
+	if err != nil {
+		return plan, err
+	}
+	if m.UserID != "" && m.UserID != userID {
+		return plan, fmt.Errorf("%s is user %s, but the manifest is for user %s", m.URL, userID, m.UserID)
+	}
+	m.UserID = userID
+	ju, err := getProfile(ctx, userID)
+	if err != nil {
+		return plan, err
+	}
+
+	synced := make(map[string]bool, len(m.Posts))
+	for _, id := range m.Posts {
+		synced[id] = true
+	}
+	current := make(map[string]bool, len(ju.Posts))
+	var ids []string
+	for _, id := range ju.Posts {
+		current[id] = true
+		if !synced[id] {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range m.Posts {
+		if !current[id] {
+			plan.Gone = append(plan.Gone, id)
+		}
+	}
+	if len(ids) > 0 {
+		plan.New, err = getVines(ctx, ids, ju.AvatarURL)
+	}
+	return plan, err
+}
+
+// Add marks vines as synced.
+func (m *Manifest) Add(vines []Vine) {
+	seen := make(map[string]bool, len(m.Posts))
+	for _, id := range m.Posts {
+		seen[id] = true
+	}
+	for _, v := range vines {
+		if !seen[v.UUID] {
+			seen[v.UUID] = true
+			m.Posts = append(m.Posts, v.UUID)
+		}
+	}
+	sort.Strings(m.Posts)
+}
@@ -0,0 +1,208 @@
+package creeperkeeper
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// errUnknownVanity is returned by VanityResolvers that don't know a name.
+var errUnknownVanity = errors.New("unknown")
+
+// A VanityResolver maps vanity names, as in vine.co/<name> profile URLs, to
+// numeric user IDs.
+type VanityResolver interface {
+	// Name identifies the resolver in error messages.
+	Name() string
+	// Resolve returns the user ID for a vanity name. Names are lowercase.
+	Resolve(ctx context.Context, name string) (userID string, err error)
+}
+
+// Vanities are the resolvers consulted, in order, for vanity profile URLs.
+// LearnedVanities is consulted after them, if it isn't nil.
+var Vanities = []VanityResolver{ArchiveVanities{}}
+
+// LearnedVanities maps the usernames of posts that have been fetched to their
+// uploaders' IDs. If nil, nothing is learned.
+var LearnedVanities *VanityCache
+
+var vanityNameRE = regexp.MustCompile(`^[a-z0-9_.-]+$`)
+
+// resolveVanity tries each resolver in turn. The error names the resolvers
+// that were tried and why they failed.
+func resolveVanity(ctx context.Context, name string) (string, error) {
+	name = strings.ToLower(name)
+	resolvers := Vanities
+	if LearnedVanities != nil {
+		resolvers = append(resolvers[:len(resolvers):len(resolvers)], LearnedVanities)
+	}
+	var tried []string
+	for _, r := range resolvers {
+		userID, err := r.Resolve(ctx, name)
+		if err == nil {
+			return userID, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		tried = append(tried, fmt.Sprintf("%s: %s", r.Name(), err))
+	}
+	if len(tried) == 0 {
+		return "", fmt.Errorf("vanity name %q: no resolvers", name)
+	}
+	return "", fmt.Errorf("vanity name %q: tried %s", name, strings.Join(tried, "; "))
+}
+
+// ArchiveVanities looks up vanity names in the archive, at
+// ArchiveURL/vanities/<name>.json, which holds an object with a userIdStr
+// field.
+type ArchiveVanities struct{}
+
+func (ArchiveVanities) Name() string { return "archive" }
+
+func (ArchiveVanities) Resolve(ctx context.Context, name string) (string, error) {
+	var jv jsonVanity
+	url := fmt.Sprintf("%s/vanities/%s.json", ArchiveURL, name)
+	err := deserialize(ctx, url, &jv)
+	if se, ok := err.(statusError); ok && se.StatusCode == http.StatusNotFound {
+		return "", errUnknownVanity
+	}
+	if err != nil {
+		return "", err
+	}
+	if jv.UserIdStr == "" {
+		return "", fmt.Errorf("%s: no userIdStr", url)
+	}
+	return jv.UserIdStr, nil
+}
+
+// A VanityMap is a fixed mapping from vanity names to user IDs.
+type VanityMap struct {
+	Source string // Where the mapping came from, for error messages.
+	Names  map[string]string
+}
+
+// ReadVanityFile reads a mapping file with a vanity name and a user ID on
+// each line, separated by whitespace. Blank lines and lines starting with #
+// are ignored.
+func ReadVanityFile(name string) (*VanityMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &VanityMap{Source: name, Names: map[string]string{}}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and a user ID", name, n)
+		}
+		m.Names[strings.ToLower(fields[0])] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *VanityMap) Name() string { return m.Source }
+
+func (m *VanityMap) Resolve(ctx context.Context, name string) (string, error) {
+	userID, ok := m.Names[name]
+	if !ok {
+		return "", errUnknownVanity
+	}
+	return userID, nil
+}
+
+// A VanityCache is a mapping from vanity names to user IDs that's saved in a
+// file as it's learned.
+type VanityCache struct {
+	File string
+
+	mu    sync.Mutex
+	names map[string]string
+}
+
+// OpenVanityCache loads a learned mapping, if the file exists.
+func OpenVanityCache(file string) (*VanityCache, error) {
+	c := &VanityCache{File: file, names: map[string]string{}}
+	err := decodeFile(file, &c.names)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *VanityCache) Name() string { return "learned" }
+
+func (c *VanityCache) Resolve(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	userID, ok := c.names[name]
+	if !ok {
+		return "", errUnknownVanity
+	}
+	return userID, nil
+}
+
+// learn records the mapping from a vine's uploader's username to their user
+// ID. Usernames are display names and aren't always usable as vanity names,
+// but often are.
+func (c *VanityCache) learn(v Vine) error {
+	if c == nil || v.UploaderID == "" {
+		return nil
+	}
+	name := strings.ToLower(v.Uploader)
+	if !vanityNameRE.MatchString(name) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.names[name] == v.UploaderID {
+		return nil
+	}
+	c.names[name] = v.UploaderID
+	return c.save()
+}
+
+// save writes the mapping to the cache file. c.mu must be held.
+func (c *VanityCache) save() error {
+	b, err := json.Marshal(c.names)
+	if err != nil {
+		return err
+	}
+	err = mkdirFor(c.File)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(c.File), "tmp_vanities")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.File)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
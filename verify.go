@@ -0,0 +1,183 @@
+package creeperkeeper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	videoStreamRE = regexp.MustCompile(`(?m)^streams\.stream\.\d+\.codec_type="video"`)
+	durationRE    = regexp.MustCompile(`(?m)^format\.duration="([0-9.]+)"`)
+)
+
+// FFprobeAvailable reports whether ffprobe is in PATH, which is necessary for
+// probing videos.
+func FFprobeAvailable() bool {
+	_, err := exec.LookPath("ffprobe")
+	return err == nil
+}
+
+// ProbeVideo uses ffprobe to check that file is a readable container with a
+// video stream and a non-zero duration.
+func ProbeVideo(ctx context.Context, file string) error {
+	cmd := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type:format=duration",
+		"-of", "flat",
+		file)
+	stdout, err := runCmd(cmd)
+	if err != nil {
+		return err
+	}
+	if !videoStreamRE.Match(stdout) {
+		return fmt.Errorf("%s: no video stream", file)
+	}
+	_, err = parseDuration(file, stdout)
+	return err
+}
+
+// videoDuration uses ffprobe to get the duration of a video.
+func videoDuration(ctx context.Context, file string) (time.Duration, error) {
+	cmd := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "flat",
+		file)
+	stdout, err := runCmd(cmd)
+	if err != nil {
+		return 0, err
+	}
+	return parseDuration(file, stdout)
+}
+
+// parseDuration gets a positive format duration from ffprobe's flat output.
+func parseDuration(file string, stdout []byte) (time.Duration, error) {
+	m := durationRE.FindSubmatch(stdout)
+	if m == nil {
+		return 0, fmt.Errorf("%s: unknown duration", file)
+	}
+	secs, err := strconv.ParseFloat(string(m[1]), 64)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("%s: bad duration %q", file, m[1])
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// recordChecksum sets a vine's Size and SHA256 fields from its video file. If
+// probe is true the video is also checked with ProbeVideo, and Verified is
+// set if it passes.
+func recordChecksum(ctx context.Context, v *Vine, probe bool) error {
+	file := v.VideoFilename()
+	size, sum, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+	v.Size, v.SHA256 = size, sum
+	if !probe {
+		return nil
+	}
+	err = ProbeVideo(ctx, file)
+	if err != nil {
+		return err
+	}
+	v.Verified = time.Now().UTC().Truncate(time.Second)
+	return nil
+}
+
+// KeepChecksum copies the size and checksum recorded in a vine's existing
+// metadata file, if any, to the vine, eg when its video was downloaded by an
+// earlier run and its metadata is about to be rewritten.
+func KeepChecksum(v *Vine) {
+	old, err := ReadVineMetadata(v.MetadataFilename())
+	if err != nil || old.UUID != v.UUID {
+		return
+	}
+	v.Size, v.SHA256, v.Verified = old.Size, old.SHA256, old.Verified
+}
+
+// hashFile returns the size and hex-encoded SHA-256 of a file.
+func hashFile(name string) (size int64, sum string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A VideoProblem describes a vine whose video is missing or corrupt.
+type VideoProblem struct {
+	Vine    Vine
+	Missing bool
+	Err     error
+}
+
+func (p VideoProblem) Error() string {
+	if p.Missing {
+		return fmt.Sprintf("%s: missing", p.Vine.VideoFilename())
+	}
+	return fmt.Sprintf("%s: corrupt: %s", p.Vine.VideoFilename(), p.Err)
+}
+
+// CheckVideos rechecks vines' video files against the size and checksum
+// recorded in their metadata, and with ProbeVideo if probe is true. Vines
+// without a recorded checksum are only probed. Checking stops when ctx is
+// done, in which case ctx's error is returned along with the problems found
+// so far.
+func CheckVideos(ctx context.Context, vines []Vine, probe bool) ([]VideoProblem, error) {
+	var problems []VideoProblem
+	for _, v := range vines {
+		if ctx.Err() != nil {
+			return problems, ctx.Err()
+		}
+		err := checkVideo(ctx, v, probe)
+		if os.IsNotExist(err) {
+			problems = append(problems, VideoProblem{Vine: v, Missing: true, Err: err})
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return problems, ctx.Err()
+			}
+			problems = append(problems, VideoProblem{Vine: v, Err: err})
+		}
+	}
+	return problems, nil
+}
+
+func checkVideo(ctx context.Context, v Vine, probe bool) error {
+	file := v.VideoFilename()
+	if v.SHA256 != "" {
+		size, sum, err := hashFile(file)
+		if err != nil {
+			return err
+		}
+		if size != v.Size {
+			return fmt.Errorf("size is %d bytes, want %d", size, v.Size)
+		}
+		if sum != v.SHA256 {
+			return fmt.Errorf("sha256 is %s, want %s", sum, v.SHA256)
+		}
+	} else if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	if probe {
+		return ProbeVideo(ctx, file)
+	}
+	return nil
+}
@@ -2,12 +2,14 @@ package creeperkeeper
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/template"
 	"time"
@@ -22,31 +24,89 @@ type Vine struct {
 	URL        string
 	UUID       string
 	Created    time.Time
+
+	// Fields added after the metadata format was first established are
+	// zero when read from older metadata files.
+	Loops        int64
+	Likes        int64
+	Reposts      int64
+	Comments     int64
+	Venue        string
+	Hashtags     []string  // Without the leading #.
+	Mentions     []Mention // Users mentioned in the title.
+	ThumbnailURL string
+	AvatarURL    string
+	Explicit     bool
+	Permalink    string
+
+	// Paths of downloaded images, if any.
+	ThumbnailFile string
+	AvatarFile    string
+
+	// The size and hex-encoded SHA-256 of the video file, recorded when it's
+	// downloaded, and when it was last found to be playable by ffprobe.
+	Size     int64
+	SHA256   string
+	Verified time.Time
+
+	// base is the path shared by the vine's files, without an extension, if
+	// the vine was read from a metadata file.
+	base string
+}
+
+// Mention is a reference to a user in a vine's title.
+type Mention struct {
+	UserID   string
+	Username string
 }
 
+// Download writes the vine's video to w. Reading the video is throttled by
+// BandwidthLimiter.
 func (v Vine) Download(w io.Writer) error {
-	resp, err := http.Get(v.URL)
-	if err != nil {
-		return err
+	return v.DownloadContext(context.Background(), w)
+}
+
+// DownloadContext is like Download but gives up when ctx is done.
+func (v Vine) DownloadContext(ctx context.Context, w io.Writer) error {
+	return download(ctx, v.URL, w)
+}
+
+// basePath returns the path shared by the vine's files, without an extension.
+// It's determined by Output unless the vine was read from a metadata file, in
+// which case it's next to that file.
+func (v Vine) basePath() string {
+	if v.base != "" {
+		return v.base
 	}
-	defer resp.Body.Close()
-	_, err = io.Copy(w, resp.Body)
+	base, err := Output.Base(v)
 	if err != nil {
-		return fmt.Errorf("download %s: %s", v.URL, err)
+		// NewLayout checks patterns, so this is unlikely.
+		log.Printf("filename pattern for %s: %s", v.UUID, err)
+		return filepath.Join(Output.Dir, v.UUID)
 	}
-	return nil
+	return base
 }
 
 func (v Vine) VideoFilename() string {
-	return v.UUID + ".mp4"
+	return v.basePath() + ".mp4"
+}
+
+func (v Vine) ThumbnailFilename() string {
+	return v.basePath() + imageExt(v.ThumbnailURL)
+}
+
+// AvatarFilename is shared by all of a user's vines, so it's always directly
+// in Output.Dir.
+func (v Vine) AvatarFilename() string {
+	return filepath.Join(Output.Dir, sanitizePath(v.UploaderID)+".avatar"+imageExt(v.AvatarURL))
 }
 
 func (v Vine) SubtitlesFilename() string {
-	return v.UUID + ".srt"
+	return v.basePath() + ".srt"
 }
 
 func (v Vine) MetadataFilename() string {
-	return v.UUID + ".json"
+	return v.basePath() + ".json"
 }
 
 func (v Vine) Subtitles(t time.Duration, tmpl *template.Template) (string, error) {
@@ -68,11 +128,16 @@ func (v Vine) Subtitles(t time.Duration, tmpl *template.Template) (string, error
 
 // M3UEntry returns an extended M3U entry.
 func (v Vine) M3UEntry() string {
+	return v.m3uEntry(filepath.ToSlash(v.VideoFilename()))
+}
+
+// m3uEntry returns an extended M3U entry for the vine's video at path.
+func (v Vine) m3uEntry(path string) string {
 	// Cram the title onto one line.
 	title := v.Title
 	title = strings.Replace(title, "\r", "", -1)
 	title = strings.Replace(title, "\n", " ", -1)
-	return fmt.Sprintf("#EXTINF:-1,%s: %s\n%s", v.Uploader, title, v.VideoFilename())
+	return fmt.Sprintf("#EXTINF:-1,%s: %s\n%s", v.Uploader, title, path)
 }
 
 func ReadAllVineMetadata(filenames []string) ([]Vine, error) {
@@ -92,22 +157,36 @@ func ReadAllVineMetadata(filenames []string) ([]Vine, error) {
 	return vines, nil
 }
 
+// ReadVineMetadata reads a metadata file written by WriteVineMetadata,
+// migrating it from older versions of the format as needed. Files in a newer
+// version than MetadataVersion can't be read. Fields that Vine doesn't have
+// are ignored, with a warning, since they'd be lost if the file were
+// rewritten.
 func ReadVineMetadata(filename string) (Vine, error) {
-	var vine Vine
 	f, err := os.Open(filename)
 	if err != nil {
-		return vine, err
+		return Vine{}, err
 	}
 	defer f.Close()
-	dec := json.NewDecoder(f)
-	err = dec.Decode(&vine)
+	vine, _, unknown, err := decodeVineMetadata(f)
 	if err != nil {
 		return vine, err
 	}
-	return vine, err
+	if len(unknown) > 0 {
+		log.Printf("%s: ignoring unknown fields: %s", filename, strings.Join(unknown, ", "))
+	}
+	vine.base = strings.TrimSuffix(filename, ".json")
+	return vine, nil
 }
 
+// WriteAllVineMetadata writes each vine's metadata to its MetadataFilename.
+// Nothing is written if two different vines have the same UUID or filenames,
+// and vines that are listed more than once are written once.
 func WriteAllVineMetadata(vines []Vine) error {
+	if err := checkIDs(vines); err != nil {
+		return err
+	}
+	vines = DedupeVines(vines)
 	nerr := 0
 	for _, vine := range vines {
 		err := WriteVineMetadata(vine)
@@ -122,18 +201,57 @@ func WriteAllVineMetadata(vines []Vine) error {
 	return nil
 }
 
+// WriteVineMetadata writes a vine's metadata to its MetadataFilename, in the
+// current version of the format, replacing any existing file atomically.
+// Files in a newer version of the format aren't replaced, since whatever
+// that version added would be lost.
 func WriteVineMetadata(vine Vine) error {
-	f, err := os.Create(vine.MetadataFilename())
+	name := vine.MetadataFilename()
+	if v := metadataFileVersion(name); v > MetadataVersion {
+		return fmt.Errorf("%s has newer metadata version %d, not replacing it", name, v)
+	}
+	err := mkdirFor(name)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		if cerr := f.Close(); cerr != nil && err == nil {
-			err = cerr
+	b, err := json.Marshal(metadataFile{Version: MetadataVersion, Vine: vine})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "tmp_metadata")
+	if err != nil {
+		return err
+	}
+	// TempFile creates files only the user can read.
+	err = tmp.Chmod(0644)
+	if err == nil {
+		_, err = tmp.Write(append(b, '\n'))
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// DedupeVines returns vines without any repeats, which are vines with the
+// same UUID as an earlier one.
+func DedupeVines(vines []Vine) []Vine {
+	seen := make(map[string]bool, len(vines))
+	unique := []Vine{}
+	for _, v := range vines {
+		if seen[v.UUID] {
+			continue
 		}
-	}()
-	enc := json.NewEncoder(f)
-	return enc.Encode(vine)
+		seen[v.UUID] = true
+		unique = append(unique, v)
+	}
+	return unique
 }
 
 // ByCreated implements sort.Interface
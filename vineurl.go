@@ -0,0 +1,160 @@
+package creeperkeeper
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// URLKind is the kind of thing a vine URL refers to.
+type URLKind int
+
+const (
+	PostURL   URLKind = iota + 1 // A single post. ID is its short ID.
+	UserURL                      // A user's posts. ID is their numeric ID.
+	VanityURL                    // A user's posts. ID is their vanity name.
+	LikesURL                     // A user's likes. ID is their numeric ID or vanity name.
+)
+
+func (k URLKind) String() string {
+	switch k {
+	case PostURL:
+		return "post"
+	case UserURL:
+		return "user"
+	case VanityURL:
+		return "vanity"
+	case LikesURL:
+		return "likes"
+	}
+	return fmt.Sprintf("URLKind(%d)", int(k))
+}
+
+// A VineURL is a parsed vine.co or archive.vine.co URL.
+type VineURL struct {
+	Kind URLKind
+	ID   string
+}
+
+var (
+	postIDRE      = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+	bareShortIDRE = regexp.MustCompile(`^[A-Za-z0-9]{11}$`)
+	userIDRE      = regexp.MustCompile(`^[0-9]+$`)
+)
+
+// Top-level vine.co paths that aren't vanity names.
+var reservedPaths = map[string]bool{
+	"v": true, "u": true, "oembed": true, "api": true, "tags": true,
+	"channels": true, "explore": true, "popular-now": true, "search": true,
+	"about": true, "terms": true, "privacy": true, "posts": true, "profiles": true,
+}
+
+// ParseVineURL recognizes the forms of URL that vines and users were
+// referred to by:
+//
+//	b9KOOWX7HUx                                  bare short ID
+//	https://vine.co/v/b9KOOWX7HUx                also /embed, /embed/simple, /card, etc
+//	https://vine.co/oembed/b9KOOWX7HUx
+//	https://archive.vine.co/posts/b9KOOWX7HUx.json
+//	https://vine.co/u/76                         user ID
+//	https://archive.vine.co/profiles/76.json
+//	https://vine.co/jack                         vanity name
+//	https://vine.co/u/76/likes                   likes, which weren't archived
+//
+// The scheme and www. are optional, and queries, fragments, surrounding
+// whitespace, brackets and quotes, and trailing punctuation are ignored.
+func ParseVineURL(rawurl string) (VineURL, error) {
+	s := strings.TrimSpace(rawurl)
+	s = strings.TrimLeft(s, `<([{'"`)
+	s = strings.TrimRight(s, `>.,;:!)]}'"`)
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimRight(s, `.,;:!)]}'"`)
+
+	if bareShortIDRE.MatchString(s) && !userIDRE.MatchString(s) {
+		return VineURL{PostURL, s}, nil
+	}
+
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return VineURL{}, fmt.Errorf("unrecognized vine url %q: %s", rawurl, err)
+	}
+	var elems []string
+	for _, e := range strings.Split(u.Path, "/") {
+		if e != "" {
+			elems = append(elems, e)
+		}
+	}
+
+	var v VineURL
+	switch strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.") {
+	case "vine.co", "m.vine.co":
+		v, err = parseVinePath(elems)
+	case "archive.vine.co":
+		v, err = parseArchivePath(elems)
+	default:
+		err = fmt.Errorf("not a vine.co host")
+	}
+	if err != nil {
+		return VineURL{}, fmt.Errorf("unrecognized vine url %q: %s", rawurl, err)
+	}
+	return v, nil
+}
+
+func parseVinePath(elems []string) (VineURL, error) {
+	if len(elems) == 0 {
+		return VineURL{}, fmt.Errorf("no path")
+	}
+	switch elems[0] {
+	case "v", "oembed":
+		// Anything after the ID picks a presentation, eg /embed/simple.
+		if len(elems) < 2 || !postIDRE.MatchString(elems[1]) {
+			return VineURL{}, fmt.Errorf("bad post ID")
+		}
+		return VineURL{PostURL, elems[1]}, nil
+	case "u":
+		if len(elems) < 2 || !userIDRE.MatchString(elems[1]) {
+			return VineURL{}, fmt.Errorf("bad user ID")
+		}
+		return userPath(UserURL, elems[1], elems[2:])
+	}
+	if reservedPaths[strings.ToLower(elems[0])] {
+		return VineURL{}, fmt.Errorf("%s pages aren't supported", elems[0])
+	}
+	if !vanityNameRE.MatchString(strings.ToLower(elems[0])) {
+		return VineURL{}, fmt.Errorf("bad vanity name")
+	}
+	return userPath(VanityURL, elems[0], elems[1:])
+}
+
+// userPath handles what follows a user ID or vanity name in a profile URL.
+func userPath(kind URLKind, id string, rest []string) (VineURL, error) {
+	if len(rest) == 0 {
+		return VineURL{kind, id}, nil
+	}
+	if len(rest) == 1 && rest[0] == "likes" {
+		return VineURL{LikesURL, id}, nil
+	}
+	return VineURL{}, fmt.Errorf("unknown profile page %q", strings.Join(rest, "/"))
+}
+
+func parseArchivePath(elems []string) (VineURL, error) {
+	if len(elems) != 2 || !strings.HasSuffix(elems[1], ".json") {
+		return VineURL{}, fmt.Errorf("not a post, profile or vanity")
+	}
+	id := strings.TrimSuffix(elems[1], ".json")
+	switch {
+	case elems[0] == "posts" && postIDRE.MatchString(id):
+		return VineURL{PostURL, id}, nil
+	case elems[0] == "profiles" && userIDRE.MatchString(id):
+		return VineURL{UserURL, id}, nil
+	case elems[0] == "vanities" && vanityNameRE.MatchString(strings.ToLower(id)):
+		return VineURL{VanityURL, id}, nil
+	}
+	return VineURL{}, fmt.Errorf("not a post, profile or vanity")
+}